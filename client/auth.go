@@ -1,14 +1,59 @@
 package client
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 
 	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
 )
 
+// Auth 用户名/密码认证（RFC 1929）使用的凭据
+type Auth struct {
+	Username string
+	Password string
+}
+
+// ErrAuthFailed 服务端拒绝了用户名/密码
+var ErrAuthFailed = errors.New("wrong user name or password")
+
+// NoAcceptableMethodError 服务端不接受客户端提供的任何认证方式（服务端回复 METHOD 0xFF）
+type NoAcceptableMethodError struct {
+	Offered []byte // 客户端提供的认证方式
+}
+
+func (e *NoAcceptableMethodError) Error() string {
+	return fmt.Sprintf("server accepts none of the offered auth methods %#v", e.Offered)
+}
+
+// Authenticate 与服务端协商认证方式并完成认证，auth 为 nil 时只提供无需认证
+func Authenticate(conn net.Conn, auth *Auth) error {
+	methods := []byte{consts.AuthTypeNoRequired}
+	if auth != nil {
+		methods = append(methods, consts.AuthTypeUnamePwd)
+	}
+
+	method, err := NegotiationAuth(conn, methods)
+	if err != nil {
+		return err
+	}
+
+	switch method {
+	case consts.AuthTypeNoRequired:
+		return nil
+	case consts.AuthTypeUnamePwd:
+		if auth == nil {
+			return fmt.Errorf("server selected unoffered auth method: %#x", method)
+		}
+		return AuthUseUnamePwd(conn, auth.Username, auth.Password)
+	case consts.AuthTypeNoAcceptable:
+		return &NoAcceptableMethodError{Offered: methods}
+	default:
+		return fmt.Errorf("server selected unoffered auth method: %#x", method)
+	}
+}
+
 // +------+------------+-----------+
 // | VER  | NMETHODS   | METHODS   |
 // +----- +------------+-----------+
@@ -18,45 +63,26 @@ import (
 // NegotiationAuth 向服务器发送身份验证信息，服务器会查看客户支持的认证方式，从中选择一种发送给客户
 // allowMethod 就是服务器指定的认证方式
 func NegotiationAuth(conn net.Conn, supportAuthMethods []byte) (allowMethod byte, err error) {
-	// +------+------------+-----------+
-	// | VER  | NMETHODS   | METHODS   |
-	// +----- +------------+-----------+
-	// |  1   |     1      | 1 to 255  |
-	// +------+------------+-----------+
-	b := []byte{consts.Version, byte(len(supportAuthMethods))}
-	for _, v := range supportAuthMethods {
-		b = append(b, v)
-	}
-
-	_, err = conn.Write(b)
-	if err != nil {
+	greeting := protocol.MethodRequest{Methods: supportAuthMethods}
+	if _, err = greeting.WriteTo(conn); err != nil {
 		return 0x00, err
 	}
 
-	// +-----+--------+
-	// | VER | METHOD |
-	// +-----+--------+
-	// |  1  |   1    |
-	// +-----+--------+
-	b = make([]byte, 2)
-	_, err = io.ReadFull(conn, b)
-	if err != nil {
-		return 0x00, fmt.Errorf("read server response error: %+v", err)
-	}
-
-	ver := b[0]
-	if ver != consts.Version {
-		return 0x00, fmt.Errorf("you connect server is not socks5")
+	var sel protocol.MethodSelection
+	if _, err = sel.ReadFrom(conn); err != nil {
+		if errors.Is(err, protocol.ErrInvalidVersion) {
+			return 0x00, fmt.Errorf("you connect server is not socks5")
+		}
+		return 0x00, fmt.Errorf("read server response error: %w", err)
 	}
 
-	allowMethod = b[1]
-	return
+	return sel.Method, nil
 }
 
 // AuthUseUnamePwd 使用 用户名/密码 方式进行校验
 func AuthUseUnamePwd(conn net.Conn, uname, pwd string) error {
+	// 缓冲为 2，提前返回时另一个 goroutine 也不会阻塞
 	errch := make(chan error, 2)
-	defer close(errch)
 
 	go func() {
 		errch <- writeUnameAndPwd(conn, uname, pwd)
@@ -76,47 +102,23 @@ func AuthUseUnamePwd(conn net.Conn, uname, pwd string) error {
 }
 
 func writeUnameAndPwd(conn net.Conn, uname, pwd string) error {
-	ulen := (byte)(len(uname))
-	plen := (byte)(len(pwd))
-
-	var buf bytes.Buffer
-
-	buf.WriteByte(consts.Version)
-	buf.WriteByte(ulen)
-	buf.WriteString(uname)
-	buf.WriteByte(plen)
-	buf.WriteString(pwd)
-
-	_, err := conn.Write(buf.Bytes())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	req := protocol.UserPassRequest{Version: consts.UserPassVersion, Username: uname, Password: pwd}
+	_, err := req.WriteTo(conn)
+	return err
 }
 
 func readAuthResponse(conn net.Conn) error {
-	b := make([]byte, 2)
-	_, err := io.ReadFull(conn, b[:])
-	//_, err := conn.Read(b)
-	if err != nil {
-		return fmt.Errorf("read response error: %+v", err)
+	var status protocol.UserPassStatus
+	if _, err := status.ReadFrom(conn); err != nil {
+		return fmt.Errorf("read response error: %w", err)
 	}
 
-	// +----+--------+
-	// |VER | STATUS |
-	// +----+--------+
-	// | 1  |   1    |
-	// +----+--------+
-	ver := b[0]
-	status := b[1]
-
-	if ver != consts.Version {
-		return fmt.Errorf("response version not socks5")
+	if status.Version != consts.UserPassVersion {
+		return fmt.Errorf("invalid username/password auth response version %#x", status.Version)
 	}
 
-	if status != consts.AuthUserOk {
-		return fmt.Errorf("wrong user name or password")
+	if status.Status != consts.AuthUserOk {
+		return ErrAuthFailed
 	}
 
 	return nil
@@ -1,16 +1,19 @@
 package client
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"time"
 
 	"zz.io/cargo/so5/consts"
-	"zz.io/cargo/so5/util"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/relay"
 )
 
 // ListenAndServer
@@ -18,112 +21,153 @@ import (
 // so5 client --listen-addr=127.0.0.1:8080 --proxy-addr=127.0.0.1:8088 --target-addr=127.0.0.1:9090
 // 其他应用通过 127.0.0.1 与 socks5 client 建立连接，然后 socks5 client 转发应用的请求
 // 所以这里的 client 实际上即是 server（对应用而言），也是 client（对 socks5 server 而言）
-func ListenAndServer(addr, proxyAddr, targetAddr string) error {
-	lis, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
-	defer lis.Close()
+// opts 为连接 socks5 server 时使用的认证信息和超时，为 nil 时不认证、不限制超时
+func ListenAndServer(addr, proxyAddr, targetAddr string, opts *Options) error {
+	f := Forward{ListenAddr: addr, ProxyAddr: proxyAddr, TargetAddr: targetAddr, Options: opts}
+	return ListenAndServeForwards(context.Background(), []Forward{f})
+}
 
-	for {
-		conn, err := lis.Accept()
-		if err != nil {
-			return err
-		}
-		log.Printf("accepted new connection, addr %v", conn.RemoteAddr())
+// Options 客户端连接 socks5 server 时使用的选项
+type Options struct {
+	// Auth 用户名/密码，为 nil 时只支持无需认证
+	Auth *Auth
 
-		go func() {
-			if err := Dial(conn, proxyAddr, targetAddr); err != nil {
-				io.WriteString(conn, err.Error())
-				return
-			}
-		}()
+	// HandshakeTimeout 与 socks5 server 完成认证、请求、回复的最长时间，为 0 时不限制
+	HandshakeTimeout time.Duration
 
-	}
+	// DialTimeout 连接 socks5 server 的最长时间，为 0 时不限制
+	DialTimeout time.Duration
+
+	// IdleTimeout 转发数据时的空闲超时，两个方向都超过该时间没有数据时关闭连接，为 0 时不限制
+	IdleTimeout time.Duration
+}
+
+// Dial 连接 addr 处的 socks5 server，完成认证后请求其连接 targetAddr，然后在 conn 和 targetAddr 之间转发数据
+func Dial(conn net.Conn, addr, targetAddr string, opts *Options) error {
+	return dialAndRelay(context.Background(), conn, addr, targetAddr, opts)
 }
 
-func Dial(conn net.Conn, addr, targetAddr string) error {
+// dialAndRelay 与 Dial 相同，ctx 结束时中断与 socks5 server 的握手
+func dialAndRelay(ctx context.Context, conn net.Conn, addr, targetAddr string, opts *Options) error {
 	if conn == nil {
 		return nil
 	}
 	defer conn.Close()
 
-	targetConn, err := net.Dial("tcp", addr)
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	targetConn, _, err := dialProxy(ctx, addr, targetAddr, opts)
 	if err != nil {
 		return err
 	}
 	defer targetConn.Close()
 
-	// TODO: Auth
-	//authMethod, err := NegotiationAuth(conn, supportAuthMethods)
-	//if err != nil {
-	//	return err
-	//}
-	//
-	//switch authMethod {
-	//case consts.AuthTypeNoRequired:
-	//	t.Log("NegotiationAuthMethod: NoRequired")
-	//case consts.AuthTypeUnamePwd:
-	//	if err := client.AuthUseUnamePwd(conn, server.Username, server.Password); err != nil {
-	//		t.Error(err)
-	//		return
-	//	}
-	//case consts.AuthTypeNoAcceptable:
-	//	t.Log("NegotiationAuthMethod: NoAcceptable")
-	//}
-
-	atyp, adr, port, err := util.ParseAddr(targetAddr)
+	stats, err := relay.Relay(conn, targetConn, opts.IdleTimeout)
+	if errors.Is(err, relay.ErrIdleTimeout) {
+		return fmt.Errorf("session idle for %v: %w", opts.IdleTimeout, err)
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("relay error after sending %d bytes and receiving %d bytes: %w", stats.AToB, stats.BToA, err)
 	}
 
-	if err := WriteRequest(targetConn, atyp, adr, port); err != nil {
-		return err
+	return nil
+}
+
+// dialProxy 连接 addr 处的 socks5 server，完成认证后请求其连接 targetAddr，
+// 成功时返回的连接上可以直接收发与 targetAddr 之间的数据，以及回复中的 BND 地址。
+// ctx 被取消或超时时中断连接和握手
+func dialProxy(ctx context.Context, addr, targetAddr string, opts *Options) (net.Conn, protocol.Addr, error) {
+	dst, err := protocol.ParseAddr(targetAddr)
+	if err != nil {
+		return nil, protocol.Addr{}, err
 	}
 
-	_, _, _, err = ReadReplyResponse(targetConn)
+	return dialProxyCmd(ctx, addr, protocol.Request{Cmd: consts.CmdConnect, Addr: dst}, opts)
+}
+
+// dialProxyCmd 连接 addr 处的 socks5 server，完成认证后发送 req，返回连接和回复中的 BND 地址
+func dialProxyCmd(ctx context.Context, addr string, req protocol.Request, opts *Options) (net.Conn, protocol.Addr, error) {
+	d := net.Dialer{Timeout: opts.DialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		return err
+		return nil, protocol.Addr{}, err
+	}
+
+	if opts.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(opts.HandshakeTimeout))
 	}
+	// 握手期间 ctx 结束时让阻塞的读写立即返回
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
 
-	go func() {
-		if _, er := io.Copy(targetConn, conn); er != nil {
-			err = er
-			log.Println(err)
-			return
+	bnd, err := proxyHandshake(conn, req, opts)
+	if err != nil {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, protocol.Addr{}, ctx.Err()
 		}
-	}()
+		return nil, protocol.Addr{}, handshakeError(err, opts.HandshakeTimeout)
+	}
 
-	if _, err := io.Copy(conn, targetConn); err != nil {
-		log.Println(err)
-		return err
+	if !stop() {
+		// 握手恰好完成时 ctx 结束，连接的超时已被修改，不能再使用
+		conn.Close()
+		return nil, protocol.Addr{}, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, bnd, nil
+}
+
+// proxyHandshake 完成认证，发送请求并读取回复，返回回复中的 BND 地址
+func proxyHandshake(conn net.Conn, req protocol.Request, opts *Options) (protocol.Addr, error) {
+	if err := Authenticate(conn, opts.Auth); err != nil {
+		return protocol.Addr{}, err
 	}
 
+	if _, err := req.WriteTo(conn); err != nil {
+		return protocol.Addr{}, err
+	}
+
+	return readReply(conn)
+}
+
+// readReply 读取服务端的回复，REP 不为成功时返回错误
+func readReply(r io.Reader) (protocol.Addr, error) {
+	var reply protocol.Reply
+	if _, err := reply.ReadFrom(r); err != nil {
+		return protocol.Addr{}, fmt.Errorf("read reply error: %w", err)
+	}
+	if reply.Rep != consts.RepSuccess {
+		return protocol.Addr{}, &ReplyError{Rep: reply.Rep}
+	}
+	return reply.Addr, nil
+}
+
+// handshakeError 握手超时时给出更明确的原因
+func handshakeError(err error, timeout time.Duration) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("handshake with proxy not completed within %v: %w", timeout, err)
+	}
 	return err
 }
 
 func WriteRequest(conn net.Conn, atyp byte, addr []byte, targetPort uint16) error {
-	// +----+-----+-------+------+----------+----------+
-	// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
-	// +----+-----+-------+------+----------+----------+
-	// | 1  |  1  | X'00' |  1   | Variable |    2     |
-	// +----+-----+-------+------+----------+----------+
-
-	var b bytes.Buffer
-	b.WriteByte(consts.Version)
-	b.WriteByte(consts.CmdConnect)
-	b.WriteByte(consts.RSV)
-	b.WriteByte(atyp)
-	b.Write(addr) // DST.ADDR
-
-	pp := make([]byte, 2)
-	// 以大端的方式将 8888 转换为 2 字节
-	binary.BigEndian.PutUint16(pp, targetPort)
-	b.Write(pp)
-
-	_, err := conn.Write(b.Bytes())
-	if err != nil {
-		errMsg := fmt.Errorf("write request to conn error: %+v", err)
+	return WriteCmdRequest(conn, consts.CmdConnect, atyp, addr, targetPort)
+}
+
+// WriteCmdRequest 发送指定 CMD 的请求，CMD 可以是 CONNECT、BIND 或 UDP ASSOCIATE
+func WriteCmdRequest(conn net.Conn, cmd, atyp byte, addr []byte, targetPort uint16) error {
+	host := string(addr) // 域名
+	if atyp != consts.AtypDomain {
+		host = net.IP(addr).String()
+	}
+
+	req := protocol.Request{Cmd: cmd, Addr: protocol.Addr{Type: atyp, Host: host, Port: targetPort}}
+	if _, err := req.WriteTo(conn); err != nil {
+		errMsg := fmt.Errorf("write request to conn error: %w", err)
 		log.Println(errMsg)
 		return errMsg
 	}
@@ -131,66 +175,37 @@ func WriteRequest(conn net.Conn, atyp byte, addr []byte, targetPort uint16) erro
 	return nil
 }
 
-func ReadReplyResponse(conn net.Conn) (atyp byte, addr, port string, err error) {
-	buf := make([]byte, 255)
+// ReplyError 服务端回复的 REP 不为成功（0x00）
+type ReplyError struct {
+	Rep byte
+}
 
-	// +-----+-----+-------+------+----------+----------+
-	// | VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
-	// +-----+-----+-------+------+----------+----------+
-	// |  1  |  1  | X'00' |  1   | Variable |    2     |
-	// +-----+-----+-------+------+----------+----------+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("create conn to target addr error, REP: %d", e.Rep)
+}
 
-	// VER
-	_, err = io.ReadFull(conn, buf[:1])
+// ReplyCode 返回服务端回复的 REP，server 经由上游转发时据此把 REP 原样回复给客户端
+func (e *ReplyError) ReplyCode() byte { return e.Rep }
+
+// ReadReplyResponse 从 r（通常是与 socks5 server 的连接）中读取服务端对请求的回复，
+// REP 不为成功时返回 *ReplyError，连接在回复之前被关闭时返回包装的 io.ErrUnexpectedEOF
+func ReadReplyResponse(r io.Reader) (atyp byte, addr, port string, err error) {
+	var reply protocol.Reply
+	n, err := reply.ReadFrom(r)
 	if err != nil {
 		log.Println(err)
-		if errors.Is(err, io.EOF) {
-			return 0, "", "", nil
+		// 请求已经发出，没有收到任何回复同样是失败
+		if n == 0 && errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
 		}
-		return 0, "", "", fmt.Errorf("read reply.VER error: %v", err)
-	}
-	ver := buf[0]
-
-	// REP
-	_, err = io.ReadFull(conn, buf[:1])
-	if err != nil {
-		return 0, "", "", fmt.Errorf("read reply.REP error")
-	}
-	rep := buf[0]
-	if rep != consts.RepSuccess {
-		return 0, "", "", fmt.Errorf("create conn to target addr error, REP: %d", rep)
-	}
-
-	// RSV
-	_, err = io.ReadFull(conn, buf[:1])
-	if err != nil {
-		return 0, "", "", fmt.Errorf("read RSV error")
+		return 0, "", "", fmt.Errorf("read reply error: %w", err)
 	}
-	rsv := buf[0]
-	//fmt.Printf("rsv: %v\n", rsv)
 
-	// ATYP
-	_, err = io.ReadFull(conn, buf[:1])
-	if err != nil {
-		return 0, "", "", fmt.Errorf("read ATYP error")
-	}
-	atyp = buf[0]
-	//fmt.Printf("atyp: %v\n", atyp)
-
-	// BND.ADDR
-	addr, err = util.ParseAddrFromConn(atyp, conn)
-	if err != nil {
-		return
-	}
-	//fmt.Printf("addr: %v\n", addr)
-
-	port, err = util.ParsePortFromConn(conn)
-	if err != nil {
-		return
+	if reply.Rep != consts.RepSuccess {
+		return 0, "", "", &ReplyError{Rep: reply.Rep}
 	}
-	//fmt.Printf("port: %v\n", port)
 
-	log.Printf("ver: %v, rep: %v, rsv: %v, atyp: %v addr: %v, port: %v \n",
-		ver, rep, rsv, atyp, addr, port)
+	atyp, addr, port = reply.Addr.Type, reply.Addr.Host, strconv.Itoa(int(reply.Addr.Port))
+	log.Printf("rep: %v, atyp: %v addr: %v, port: %v \n", reply.Rep, atyp, addr, port)
 	return
 }
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/util/testutil"
+)
+
+func init() {
+	// 解析时会打印日志，模糊测试中没有意义
+	log.SetOutput(io.Discard)
+}
+
+func FuzzReadReplyResponse(f *testing.F) {
+	seeds := [][]byte{
+		{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x1f, 0x90},
+		append(append([]byte{0x05, 0x00, 0x00, 0x03, 11}, "example.com"...), 0x01, 0xbb),
+		append(append([]byte{0x05, 0x00, 0x00, 0x04}, net.IPv6loopback...), 0x00, 0x50),
+		{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0},         // 连接被拒
+		{0x04, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x1f, 0x90}, // 版本错误
+		{0x05, 0x00, 0x00, 0x09, 127, 0, 0, 1, 0x1f, 0x90}, // 未知的 ATYP
+		{0x05, 0x00, 0x00, 0x03, 0xff, 'a'},                // 域名长度超过剩余数据
+		{0x05, 0x00},                                       // 截断
+		{},                                                 // 回复之前连接被关闭
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		var (
+			atyp       byte
+			addr, port string
+			err        error
+		)
+		testutil.AssertBoundedAlloc(t, testutil.MaxParseAlloc, func() {
+			atyp, addr, port, err = ReadReplyResponse(r)
+		})
+		if err != nil {
+			// 连接在回复之前被关闭同样是失败
+			if len(data) == 0 && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("ReadReplyResponse(%v) error = %v, want %v", data, err, io.ErrUnexpectedEOF)
+			}
+			return
+		}
+
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			t.Fatalf("invalid port %q", port)
+		}
+		reply := protocol.Reply{Rep: consts.RepSuccess, Addr: protocol.Addr{Type: atyp, Host: addr, Port: uint16(p)}}
+		b, err := reply.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() of %+v error = %v", reply, err)
+		}
+		if read := data[:len(data)-r.Len()]; !bytes.Equal(b, read) {
+			t.Fatalf("re-encoded %v, read %v", b, read)
+		}
+	})
+}
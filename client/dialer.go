@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+)
+
+// Dialer 经由 ProxyAddr 处的 socks5 server 连接目标。
+//
+// Dial 和 DialContext 与 golang.org/x/net/proxy 中的 Dialer、ContextDialer 接口一致，
+// 可以直接用于 http.Transport.DialContext、grpc.WithContextDialer 等
+type Dialer struct {
+	ProxyAddr string
+
+	// Options 连接 ProxyAddr 时使用的认证信息和超时，为 nil 时不认证、不限制超时。
+	// IdleTimeout 不使用，连接交给调用方后由调用方自行管理
+	Options *Options
+}
+
+// Dial 与 DialContext 相同，使用 context.Background()
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext 连接 socks5 server 并请求其 CONNECT addr，network 只支持 tcp、tcp4、tcp6。
+//
+// ctx 在握手完成之前结束时中断连接和握手并返回 ctx.Err()，握手完成之后不再影响返回的连接。
+// 返回的连接的 RemoteAddr 为 addr：IP 地址时为 *net.TCPAddr，域名时 String() 为 addr
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	dst, err := protocol.ParseAddr(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	conn, _, err := dialProxyCmd(ctx, d.ProxyAddr, protocol.Request{Cmd: consts.CmdConnect, Addr: dst}, d.options())
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: targetAddr(dst), Err: err}
+	}
+
+	return &proxiedConn{Conn: conn, remote: targetAddr(dst)}, nil
+}
+
+func (d *Dialer) options() *Options {
+	if d.Options == nil {
+		return &Options{}
+	}
+	return d.Options
+}
+
+// proxiedConn 经由 socks5 server 建立的连接，RemoteAddr 为目标的地址而不是 socks5 server 的地址
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+
+// CloseWrite 半关闭，保留底层 TCP 连接的能力，底层连接不支持时返回 errors.ErrUnsupported
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// hostAddr 目标为域名时的地址，由 socks5 server 解析
+type hostAddr struct {
+	protocol.Addr
+	network string
+}
+
+func (a hostAddr) Network() string { return a.network }
+
+// targetAddr 将请求中的目标地址转换为 net.Addr
+func targetAddr(a protocol.Addr) net.Addr {
+	if a.Type == consts.AtypDomain {
+		return hostAddr{Addr: a, network: "tcp"}
+	}
+	return &net.TCPAddr{IP: net.ParseIP(a.Host), Port: int(a.Port)}
+}
+
+// udpTargetAddr 与 targetAddr 相同，IP 地址时为 *net.UDPAddr
+func udpTargetAddr(a protocol.Addr) net.Addr {
+	if a.Type == consts.AtypDomain {
+		return hostAddr{Addr: a, network: "udp"}
+	}
+	return &net.UDPAddr{IP: net.ParseIP(a.Host), Port: int(a.Port)}
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Forward 一条端口转发：ListenAddr 上接受的连接经由 ProxyAddr 处的 socks5 server 转发到 TargetAddr
+type Forward struct {
+	ListenAddr string
+	ProxyAddr  string
+	TargetAddr string
+
+	// Remote 为 true 时是远程端口转发：ListenAddr 为 socks5 server 上监听的地址，
+	// 连入的连接经由 socks5 server 转发到客户端这一侧的 TargetAddr，服务端需要允许（Config.AllowRemoteForward）
+	Remote bool
+
+	// Options 连接 ProxyAddr 时使用的认证信息和超时，为 nil 时不认证、不限制超时
+	Options *Options
+}
+
+func (f Forward) String() string {
+	if f.Remote {
+		return f.ProxyAddr + "(" + f.ListenAddr + ") -> " + f.TargetAddr
+	}
+	return f.ListenAddr + " -> " + f.ProxyAddr + " -> " + f.TargetAddr
+}
+
+func (f Forward) options() *Options {
+	if f.Options == nil {
+		return &Options{}
+	}
+	return f.Options
+}
+
+// ListenAndServeForwards 在同一个进程中运行多条端口转发（包括远程端口转发）。
+//
+// 所有地址都监听成功（远程端口转发为服务端监听成功）后才开始接受连接，任意一个失败时返回错误。
+// ctx 结束时关闭所有监听和正在转发的连接并返回 nil；
+// 某条转发接受连接出错时同样关闭其余转发，并返回该错误
+func ListenAndServeForwards(ctx context.Context, forwards []Forward) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	serves := make([]func() error, 0, len(forwards))
+	closers := make([]io.Closer, 0, len(forwards))
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	for _, f := range forwards {
+		if f.Remote {
+			control, bnd, err := openRemoteForward(ctx, f)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			closers = append(closers, control)
+			serves = append(serves, func() error { return serveRemoteForward(ctx, control, f) })
+			log.Printf("remote forward %v listening on %v", f, bnd)
+			continue
+		}
+
+		lis, err := net.Listen("tcp", f.ListenAddr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		closers = append(closers, lis)
+		serves = append(serves, func() error { return serveForward(ctx, lis, f) })
+		log.Printf("forward %v listening", f)
+	}
+
+	stop := context.AfterFunc(ctx, closeAll)
+	defer stop()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		serveErr error
+	)
+	for _, serve := range serves {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serve(); err != nil && ctx.Err() == nil {
+				errOnce.Do(func() { serveErr = err })
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return serveErr
+}
+
+// serveForward 在 lis 上接受连接并转发，ctx 结束时关闭正在转发的连接，等待它们结束后返回
+func serveForward(ctx context.Context, lis net.Listener, f Forward) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) && ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		log.Printf("forward %v accepted new connection, addr %v", f, conn.RemoteAddr())
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+
+			if err := dialAndRelay(ctx, conn, f.ProxyAddr, f.TargetAddr, f.options()); err != nil {
+				log.Printf("forward %v connection from %v closed: %v", f, conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"net"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/server"
+)
+
+// NewLocalServer 创建面向本机应用的代理服务端：应用以 SOCKS5、SOCKS4/4a 或 HTTP 代理的方式连接，
+// 服务端从每个请求中取得目标地址，再通过 proxyAddr 处的 socks5 server 连接目标并转发数据。
+//
+// 本地服务端不需要认证，应当只监听在本机地址上；只支持 CONNECT，
+// BIND 和 UDP ASSOCIATE 无法经由上游转发，回复 REP 0x02（规则不允许）。
+// CONNECT 的回复使用上游回复中的 REP 和 BND.ADDR/BND.PORT，上游回复的 BND 为域名时回复 0.0.0.0:0。
+// opts 为连接上游时使用的认证信息和超时，为 nil 时不认证、不限制超时
+func NewLocalServer(proxyAddr string, opts *Options) *server.Server {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	return server.New(server.Config{
+		HandshakeTimeout: opts.HandshakeTimeout,
+		IdleTimeout:      opts.IdleTimeout,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, bnd, err := dialProxy(ctx, proxyAddr, addr, opts)
+			if err != nil {
+				return nil, err
+			}
+			return &upstreamConn{Conn: conn, bound: targetAddr(bnd)}, nil
+		},
+		AllowRequest: func(ctx context.Context, req *server.Request) bool {
+			return req.Cmd == consts.CmdConnect
+		},
+	})
+}
+
+// ListenAndServeLocal 在 addr 上运行 NewLocalServer 创建的服务端，
+// 浏览器等应用可以直接把 addr 设置为 SOCKS5 或 HTTP 代理
+func ListenAndServeLocal(addr, proxyAddr string, opts *Options) error {
+	return NewLocalServer(proxyAddr, opts).ListenAndServe(addr)
+}
+
+// upstreamConn 经由上游 socks5 server 建立的连接，BoundAddr 为上游回复中的 BND，用于回复应用；
+// NetConn 返回与上游之间的连接，使服务端转发时仍然可以使用 splice
+type upstreamConn struct {
+	net.Conn
+	bound net.Addr
+}
+
+func (c *upstreamConn) BoundAddr() net.Addr { return c.bound }
+
+func (c *upstreamConn) NetConn() net.Conn { return c.Conn }
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/relay"
+)
+
+// openRemoteForward 请求 f.ProxyAddr 处的 socks5 server 在 f.ListenAddr 上监听（私有命令 CmdRemoteListen），
+// 返回控制连接和服务端实际监听的地址
+func openRemoteForward(ctx context.Context, f Forward) (net.Conn, protocol.Addr, error) {
+	addr, err := protocol.ParseAddr(f.ListenAddr)
+	if err != nil {
+		return nil, protocol.Addr{}, err
+	}
+
+	conn, bnd, err := dialProxyCmd(ctx, f.ProxyAddr, protocol.Request{Cmd: consts.CmdRemoteListen, Addr: addr}, f.options())
+	if err != nil {
+		return nil, protocol.Addr{}, fmt.Errorf("remote forward %v: %w", f, err)
+	}
+	return conn, bnd, nil
+}
+
+// serveRemoteForward 从控制连接上读取服务端发来的连入通知，为每个连入的连接新建一个到服务端的连接，
+// 通过 CmdRemoteAccept 认领后与 f.TargetAddr 之间转发数据。
+// ctx 结束时关闭控制连接和正在转发的连接，等待它们结束后返回 nil；控制连接断开时返回错误
+func serveRemoteForward(ctx context.Context, control net.Conn, f Forward) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer control.Close()
+	stop := context.AfterFunc(ctx, func() { control.Close() })
+	defer stop()
+
+	for {
+		peer, err := readReply(control)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("remote forward %v control connection closed: %w", f, err)
+		}
+		log.Printf("remote forward %v accepted new connection, addr %v", f, peer)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := acceptRemote(ctx, f, peer); err != nil {
+				log.Printf("remote forward %v connection from %v closed: %v", f, peer, err)
+			}
+		}()
+	}
+}
+
+// acceptRemote 认领 peer 连入的连接，然后在它与 f.TargetAddr 之间转发数据
+func acceptRemote(ctx context.Context, f Forward, peer protocol.Addr) error {
+	opts := f.options()
+	conn, _, err := dialProxyCmd(ctx, f.ProxyAddr, protocol.Request{Cmd: consts.CmdRemoteAccept, Addr: peer}, opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	d := net.Dialer{Timeout: opts.DialTimeout}
+	target, err := d.DialContext(ctx, "tcp", f.TargetAddr)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	stats, err := relay.Relay(conn, target, opts.IdleTimeout)
+	if errors.Is(err, relay.ErrIdleTimeout) {
+		return fmt.Errorf("session idle for %v: %w", opts.IdleTimeout, err)
+	}
+	if err != nil {
+		return fmt.Errorf("relay error after sending %d bytes and receiving %d bytes: %w", stats.AToB, stats.BToA, err)
+	}
+	return nil
+}
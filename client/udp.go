@@ -0,0 +1,133 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+)
+
+// maxUDPPacketSize UDP 数据报的最大长度
+const maxUDPPacketSize = 64 * 1024
+
+// ListenPacket 在本地监听 addr（为空时使用随机端口），并在与 socks5 server 的控制连接上完成 UDP ASSOCIATE，
+// network 只支持 udp、udp4、udp6。
+//
+// 返回的 net.PacketConn 发送时自动加上 UDP 请求头部（RFC 1928，7. Procedure for UDP-based clients）
+// 交给服务端转发，收到的数据报去掉头部后返回，ReadFrom 返回的地址为实际发送数据的目标地址。
+// 关闭时同时关闭控制连接，控制连接被服务端关闭后读写返回错误。
+// ctx 在握手完成之前结束时中断握手并返回 ctx.Err()
+func (d *Dialer) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	if addr == "" {
+		addr = ":0"
+	}
+
+	var lc net.ListenConfig
+	local, err := lc.ListenPacket(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// DST.ADDR 为 0 表示由服务端使用控制连接的源 IP，DST.PORT 为本地发送数据报的端口
+	dst := protocol.Addr{Type: consts.AtypIPv4, Host: "0.0.0.0", Port: uint16(local.LocalAddr().(*net.UDPAddr).Port)}
+	if network == "udp6" {
+		dst.Type, dst.Host = consts.AtypIpv6, "::"
+	}
+	ctrl, bnd, err := dialProxyCmd(ctx, d.ProxyAddr, protocol.Request{Cmd: consts.CmdUdp, Addr: dst}, d.options())
+	if err != nil {
+		local.Close()
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: local.LocalAddr(), Err: err}
+	}
+
+	relayAddr := &net.UDPAddr{IP: net.ParseIP(bnd.Host), Port: int(bnd.Port)}
+	// 服务端监听在未指定的地址上时，使用控制连接的对端地址
+	if relayAddr.IP == nil || relayAddr.IP.IsUnspecified() {
+		if tcpAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relayAddr.IP = tcpAddr.IP
+		}
+	}
+
+	c := &udpConn{PacketConn: local, ctrl: ctrl, relay: relayAddr}
+	// 控制连接上不会再有数据，读到 EOF 或出错说明关联已经结束
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		local.Close()
+	}()
+	return c, nil
+}
+
+// udpConn 经由 socks5 server 收发数据报的 net.PacketConn
+type udpConn struct {
+	net.PacketConn
+	ctrl  net.Conn     // UDP ASSOCIATE 的控制连接
+	relay *net.UDPAddr // 服务端转发数据报的地址
+
+	readMu sync.Mutex
+	buf    []byte
+}
+
+// ReadFrom 读取一个来自服务端的数据报，去掉头部后复制到 p，其余来源的数据报和分片的数据报被丢弃
+func (c *udpConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.buf == nil {
+		c.buf = make([]byte, maxUDPPacketSize)
+	}
+
+	for {
+		n, src, err := c.PacketConn.ReadFrom(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if s, ok := src.(*net.UDPAddr); !ok || !s.IP.Equal(c.relay.IP) || s.Port != c.relay.Port {
+			continue
+		}
+
+		var hdr protocol.UDPHeader
+		hn, err := hdr.ReadFrom(bytes.NewReader(c.buf[:n]))
+		// 不支持分片，直接丢弃
+		if err != nil || hdr.Frag != 0x00 {
+			continue
+		}
+
+		return copy(p, c.buf[hn:n]), udpTargetAddr(hdr.Addr), nil
+	}
+}
+
+// WriteTo 加上 UDP 请求头部后把 p 发给服务端，由服务端转发给 addr，addr 可以是域名
+func (c *udpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	dst, err := protocol.ParseAddr(addr.String())
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: err}
+	}
+
+	hdr := protocol.UDPHeader{Addr: dst}
+	packet, err := hdr.MarshalBinary()
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: err}
+	}
+	if len(packet)+len(p) > maxUDPPacketSize {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: fmt.Errorf("datagram too large: %d bytes", len(p))}
+	}
+
+	if _, err := c.PacketConn.WriteTo(append(packet, p...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close 关闭本地的 UDP socket 和控制连接，服务端随之结束关联
+func (c *udpConn) Close() error {
+	c.ctrl.Close()
+	return c.PacketConn.Close()
+}
@@ -1,8 +1,15 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 	"zz.io/cargo/so5/client"
 
 	"github.com/spf13/cobra"
@@ -12,25 +19,218 @@ import (
 var cliOpts = &ClientOptions{}
 
 type ClientOptions struct {
-	listenAddr string
-	proxyAddr  string
-	targetAddr string
+	listenAddr   string
+	proxyAddr    string
+	targetAddr   string
+	dynamic      bool
+	forwards     []string
+	remotes      []string
+	configFile   string
+	username     string
+	password     string
+	passwordFile string
+
+	handshakeTimeout time.Duration
+	dialTimeout      time.Duration
+	idleTimeout      time.Duration
 }
 
 func (c *ClientOptions) AddFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&c.listenAddr, "listen-addr", "", "listen address")
+	fs.StringVar(&c.listenAddr, "listen-addr", "", "listen address, e.g. 127.0.0.1:8080 or [::1]:8080")
 	fs.StringVar(&c.proxyAddr, "proxy-addr", "", "proxy address")
-	fs.StringVar(&c.targetAddr, "target-addr", "", "target server addr")
+	fs.StringVar(&c.targetAddr, "target-addr", "", "target server addr, host:port, IPv6 hosts must be bracketed")
+	fs.BoolVar(&c.dynamic, "dynamic", false,
+		"listen as a SOCKS5/SOCKS4/HTTP proxy for local applications and relay each request through --proxy-addr, "+
+			"instead of forwarding to a fixed --target-addr")
+	fs.StringArrayVar(&c.forwards, "forward", nil,
+		"local=remote port forward through --proxy-addr, e.g. 127.0.0.1:2222=10.0.0.5:22, repeatable")
+	fs.StringArrayVar(&c.remotes, "remote-forward", nil,
+		"remote=local forward: the proxy listens on remote and tunnels each connection back to local, "+
+			"e.g. 0.0.0.0:8022=127.0.0.1:22, repeatable, the proxy must allow it with --allow-remote-forward")
+	fs.StringVar(&c.configFile, "config", "",
+		`JSON file {"forwards": [{"listen", "target", "remote", "proxy", "username", "password", "password_file"}]}, `+
+			"proxy and credentials default to the flags")
+	fs.StringVar(&c.username, "username", "", "username for the proxy's username/password auth")
+	fs.StringVar(&c.password, "password", "", "password for the proxy's username/password auth")
+	fs.StringVar(&c.passwordFile, "password-file", "", "file containing the password, trailing newline is ignored")
+	fs.DurationVar(&c.handshakeTimeout, "handshake-timeout", 10*time.Second,
+		"max time for auth, request and reply with the proxy, 0 disables")
+	fs.DurationVar(&c.dialTimeout, "dial-timeout", 10*time.Second, "max time to connect to the proxy, 0 disables")
+	fs.DurationVar(&c.idleTimeout, "idle-timeout", 5*time.Minute,
+		"close a session after no data in either direction for this long, 0 disables")
+}
+
+// auth 根据 --username、--password、--password-file 构造认证信息，未指定用户名时返回 nil
+func (c *ClientOptions) auth() (*client.Auth, error) {
+	return loadAuth("--", c.username, c.password, c.passwordFile)
+}
+
+// loadAuth 根据用户名、密码或密码文件构造认证信息，未指定用户名时返回 nil，
+// prefix 为错误信息中参数名的前缀
+func loadAuth(prefix, username, password, passwordFile string) (*client.Auth, error) {
+	if password != "" && passwordFile != "" {
+		return nil, fmt.Errorf("%spassword and %spassword-file are mutually exclusive", prefix, prefix)
+	}
+	if username == "" {
+		if password != "" || passwordFile != "" {
+			return nil, fmt.Errorf("%spassword and %spassword-file require %susername", prefix, prefix, prefix)
+		}
+		return nil, nil
+	}
+
+	pwd := password
+	if passwordFile != "" {
+		b, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		pwd = strings.TrimRight(string(b), "\r\n")
+	}
+
+	return &client.Auth{Username: username, Password: pwd}, nil
+}
+
+// forwardConfig --config 文件中的一条端口转发，proxy 和认证信息为空时使用命令行参数，
+// remote 为 true 时是远程端口转发，listen 为 proxy 上监听的地址，例如：
+//
+//	{
+//	  "forwards": [
+//	    {"listen": "127.0.0.1:2222", "target": "10.0.0.5:22"},
+//	    {"listen": "0.0.0.0:8022", "target": "127.0.0.1:22", "remote": true},
+//	    {"listen": "127.0.0.1:5432", "target": "db:5432", "proxy": "10.0.1.1:1080",
+//	     "username": "alice", "password_file": "/etc/so5/alice"}
+//	  ]
+//	}
+type forwardConfig struct {
+	Listen       string `json:"listen"`
+	Target       string `json:"target"`
+	Remote       bool   `json:"remote"`
+	Proxy        string `json:"proxy"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	PasswordFile string `json:"password_file"`
+}
+
+type clientConfig struct {
+	Forwards []forwardConfig `json:"forwards"`
+}
+
+// forwardList 将 --listen-addr/--target-addr、--forward、--remote-forward 和 --config 转换为端口转发列表
+func (c *ClientOptions) forwardList() ([]client.Forward, error) {
+	auth, err := c.auth()
+	if err != nil {
+		return nil, err
+	}
+	defaults := c.options(auth)
+
+	var forwards []client.Forward
+	if c.listenAddr != "" || c.targetAddr != "" {
+		forwards = append(forwards, client.Forward{
+			ListenAddr: c.listenAddr, ProxyAddr: c.proxyAddr, TargetAddr: c.targetAddr, Options: defaults,
+		})
+	}
+
+	for _, fw := range c.forwards {
+		local, remote, ok := strings.Cut(fw, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --forward %q, want local=remote", fw)
+		}
+		forwards = append(forwards, client.Forward{
+			ListenAddr: local, ProxyAddr: c.proxyAddr, TargetAddr: remote, Options: defaults,
+		})
+	}
+
+	for _, fw := range c.remotes {
+		remote, local, ok := strings.Cut(fw, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --remote-forward %q, want remote=local", fw)
+		}
+		forwards = append(forwards, client.Forward{
+			ListenAddr: remote, ProxyAddr: c.proxyAddr, TargetAddr: local, Remote: true, Options: defaults,
+		})
+	}
+
+	if c.configFile != "" {
+		b, err := os.ReadFile(c.configFile)
+		if err != nil {
+			return nil, err
+		}
+		var cfg clientConfig
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("parse %v: %w", c.configFile, err)
+		}
+
+		for i, fc := range cfg.Forwards {
+			f := client.Forward{
+				ListenAddr: fc.Listen, ProxyAddr: fc.Proxy, TargetAddr: fc.Target, Remote: fc.Remote, Options: defaults,
+			}
+			if f.ProxyAddr == "" {
+				f.ProxyAddr = c.proxyAddr
+			}
+			if fc.Username != "" || fc.Password != "" || fc.PasswordFile != "" {
+				auth, err := loadAuth("", fc.Username, fc.Password, fc.PasswordFile)
+				if err != nil {
+					return nil, fmt.Errorf("%v: forwards[%d]: %w", c.configFile, i, err)
+				}
+				f.Options = c.options(auth)
+			}
+			forwards = append(forwards, f)
+		}
+	}
+
+	for _, f := range forwards {
+		if f.ListenAddr == "" || f.ProxyAddr == "" || f.TargetAddr == "" {
+			return nil, fmt.Errorf("forward %v: listen, proxy and target addresses are required", f)
+		}
+	}
+	return forwards, nil
+}
+
+// options 使用命令行中的超时构造连接 socks5 server 的选项
+func (c *ClientOptions) options(auth *client.Auth) *client.Options {
+	return &client.Options{
+		Auth:             auth,
+		HandshakeTimeout: c.handshakeTimeout,
+		DialTimeout:      c.dialTimeout,
+		IdleTimeout:      c.idleTimeout,
+	}
 }
 
 var ClientCmd = &cobra.Command{
 	Use: "client",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		log.Printf("%+v", cliOpts)
-		if cliOpts.listenAddr == "" || cliOpts.proxyAddr == "" || cliOpts.targetAddr == "" {
-			return fmt.Errorf("usage: so5 client --listen-addr=<> --proxy-addr=<> --target-addr=<>")
+		// 不打印密码
+		log.Printf("listen-addr: %v, proxy-addr: %v, target-addr: %v, dynamic: %v, forwards: %v, remote-forwards: %v, "+
+			"config: %v, username: %v", cliOpts.listenAddr, cliOpts.proxyAddr, cliOpts.targetAddr, cliOpts.dynamic,
+			cliOpts.forwards, cliOpts.remotes, cliOpts.configFile, cliOpts.username)
+
+		if cliOpts.dynamic {
+			if cliOpts.listenAddr == "" || cliOpts.proxyAddr == "" ||
+				cliOpts.targetAddr != "" || len(cliOpts.forwards) > 0 || len(cliOpts.remotes) > 0 || cliOpts.configFile != "" {
+				return fmt.Errorf("usage: so5 client --dynamic --listen-addr=<> --proxy-addr=<> " +
+					"[--username=<> --password=<> | --password-file=<>]")
+			}
+			auth, err := cliOpts.auth()
+			if err != nil {
+				return err
+			}
+			return client.ListenAndServeLocal(cliOpts.listenAddr, cliOpts.proxyAddr, cliOpts.options(auth))
 		}
-		return client.ListenAndServer(cliOpts.listenAddr, cliOpts.proxyAddr, cliOpts.targetAddr)
+
+		forwards, err := cliOpts.forwardList()
+		if err != nil {
+			return err
+		}
+		if len(forwards) == 0 {
+			return fmt.Errorf("usage: so5 client --proxy-addr=<> " +
+				"(--listen-addr=<> --target-addr=<> | --forward=<local=remote>... | --remote-forward=<remote=local>... | " +
+				"--config=<> | --dynamic --listen-addr=<>) " +
+				"[--username=<> --password=<> | --password-file=<>]")
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return client.ListenAndServeForwards(ctx, forwards)
 	},
 }
 
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"zz.io/cargo/so5/client"
+)
+
+// writeFile 在临时目录中写入 content，返回文件路径
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAuth(t *testing.T) {
+	pwFile := writeFile(t, "password", "secret\r\n")
+
+	tests := []struct {
+		name         string
+		username     string
+		password     string
+		passwordFile string
+		want         *client.Auth
+		wantErr      string
+	}{
+		{name: "no auth"},
+		{name: "password", username: "alice", password: "secret", want: &client.Auth{Username: "alice", Password: "secret"}},
+		{name: "password file", username: "alice", passwordFile: pwFile, want: &client.Auth{Username: "alice", Password: "secret"}},
+		{name: "mutually exclusive", username: "alice", password: "secret", passwordFile: pwFile,
+			wantErr: "--password and --password-file are mutually exclusive"},
+		{name: "password without username", password: "secret", wantErr: "require --username"},
+		{name: "password file without username", passwordFile: pwFile, wantErr: "require --username"},
+		{name: "missing password file", username: "alice", passwordFile: filepath.Join(t.TempDir(), "missing"),
+			wantErr: "no such file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadAuth("--", tt.username, tt.password, tt.passwordFile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadAuth error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadAuth error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("loadAuth = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardList(t *testing.T) {
+	// forward 只比较地址和认证信息，超时都来自命令行参数
+	type forward struct {
+		listen, proxy, target string
+		remote                bool
+		username, password    string
+	}
+	pwFile := writeFile(t, "password", "bob-secret\n")
+
+	tests := []struct {
+		name    string
+		opts    ClientOptions
+		config  string // --config 文件的内容，为空时不使用 --config
+		want    []forward
+		wantErr string
+	}{
+		{name: "listen and target",
+			opts: ClientOptions{listenAddr: "127.0.0.1:2222", proxyAddr: "proxy:1080", targetAddr: "10.0.0.5:22"},
+			want: []forward{{listen: "127.0.0.1:2222", proxy: "proxy:1080", target: "10.0.0.5:22"}}},
+		{name: "forward",
+			opts: ClientOptions{proxyAddr: "proxy:1080", forwards: []string{"127.0.0.1:2222=10.0.0.5:22", "[::1]:8080=[fd00::1]:80"},
+				username: "alice", password: "secret"},
+			want: []forward{
+				{listen: "127.0.0.1:2222", proxy: "proxy:1080", target: "10.0.0.5:22", username: "alice", password: "secret"},
+				{listen: "[::1]:8080", proxy: "proxy:1080", target: "[fd00::1]:80", username: "alice", password: "secret"},
+			}},
+		{name: "forward without target", opts: ClientOptions{proxyAddr: "proxy:1080", forwards: []string{"127.0.0.1:2222"}},
+			wantErr: `invalid --forward "127.0.0.1:2222"`},
+		{name: "remote forward",
+			opts: ClientOptions{proxyAddr: "proxy:1080", remotes: []string{"0.0.0.0:8022=127.0.0.1:22"}},
+			want: []forward{{listen: "0.0.0.0:8022", proxy: "proxy:1080", target: "127.0.0.1:22", remote: true}}},
+		{name: "remote forward without local", opts: ClientOptions{proxyAddr: "proxy:1080", remotes: []string{"0.0.0.0:8022"}},
+			wantErr: `invalid --remote-forward "0.0.0.0:8022"`},
+		{name: "missing proxy", opts: ClientOptions{forwards: []string{"127.0.0.1:2222=10.0.0.5:22"}},
+			wantErr: "listen, proxy and target addresses are required"},
+		{name: "missing target", opts: ClientOptions{listenAddr: "127.0.0.1:2222", proxyAddr: "proxy:1080"},
+			wantErr: "listen, proxy and target addresses are required"},
+		{name: "flags mutually exclusive",
+			opts:    ClientOptions{proxyAddr: "proxy:1080", forwards: []string{"a:1=b:2"}, username: "alice", password: "x", passwordFile: pwFile},
+			wantErr: "--password and --password-file are mutually exclusive"},
+		{name: "config",
+			opts: ClientOptions{proxyAddr: "proxy:1080", username: "alice", password: "secret"},
+			config: `{"forwards": [
+				{"listen": "127.0.0.1:2222", "target": "10.0.0.5:22"},
+				{"listen": "0.0.0.0:8022", "target": "127.0.0.1:22", "remote": true},
+				{"listen": "127.0.0.1:5432", "target": "db:5432", "proxy": "10.0.1.1:1080", "username": "bob", "password_file": "` + pwFile + `"},
+				{"listen": "127.0.0.1:6379", "target": "cache:6379", "username": "carol", "password": "carol-secret"}
+			]}`,
+			want: []forward{
+				{listen: "127.0.0.1:2222", proxy: "proxy:1080", target: "10.0.0.5:22", username: "alice", password: "secret"},
+				{listen: "0.0.0.0:8022", proxy: "proxy:1080", target: "127.0.0.1:22", remote: true, username: "alice", password: "secret"},
+				{listen: "127.0.0.1:5432", proxy: "10.0.1.1:1080", target: "db:5432", username: "bob", password: "bob-secret"},
+				{listen: "127.0.0.1:6379", proxy: "proxy:1080", target: "cache:6379", username: "carol", password: "carol-secret"},
+			}},
+		{name: "config after flags",
+			opts:   ClientOptions{proxyAddr: "proxy:1080", forwards: []string{"127.0.0.1:2222=10.0.0.5:22"}},
+			config: `{"forwards": [{"listen": "127.0.0.1:5432", "target": "db:5432"}]}`,
+			want: []forward{
+				{listen: "127.0.0.1:2222", proxy: "proxy:1080", target: "10.0.0.5:22"},
+				{listen: "127.0.0.1:5432", proxy: "proxy:1080", target: "db:5432"},
+			}},
+		{name: "config mutually exclusive",
+			opts: ClientOptions{proxyAddr: "proxy:1080"},
+			config: `{"forwards": [{"listen": "127.0.0.1:5432", "target": "db:5432",
+				"username": "bob", "password": "x", "password_file": "` + pwFile + `"}]}`,
+			wantErr: "forwards[0]: password and password-file are mutually exclusive"},
+		{name: "config password without username",
+			opts:    ClientOptions{proxyAddr: "proxy:1080"},
+			config:  `{"forwards": [{"listen": "127.0.0.1:5432", "target": "db:5432", "password": "x"}]}`,
+			wantErr: "forwards[0]: password and password-file require username"},
+		{name: "config missing listen",
+			opts:    ClientOptions{proxyAddr: "proxy:1080"},
+			config:  `{"forwards": [{"target": "db:5432"}]}`,
+			wantErr: "listen, proxy and target addresses are required"},
+		{name: "config missing proxy",
+			config:  `{"forwards": [{"listen": "127.0.0.1:5432", "target": "db:5432"}]}`,
+			wantErr: "listen, proxy and target addresses are required"},
+		{name: "config malformed", opts: ClientOptions{proxyAddr: "proxy:1080"}, config: `{"forwards": [`, wantErr: "parse "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if tt.config != "" {
+				opts.configFile = writeFile(t, "config.json", tt.config)
+			}
+
+			forwards, err := opts.forwardList()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("forwardList error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("forwardList error = %v", err)
+			}
+
+			got := make([]forward, 0, len(forwards))
+			for _, f := range forwards {
+				fw := forward{listen: f.ListenAddr, proxy: f.ProxyAddr, target: f.TargetAddr, remote: f.Remote}
+				if f.Options.Auth != nil {
+					fw.username, fw.password = f.Options.Auth.Username, f.Options.Auth.Password
+				}
+				got = append(got, fw)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("forwardList = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
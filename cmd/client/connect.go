@@ -0,0 +1,142 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
+)
+
+// so5 connect 的退出码，REP 不为成功时为 ExitReplyBase + REP（REP 0x01~0x08 对应 11~18）
+const (
+	ExitFailed       = 1  // 连接 socks5 server 失败、握手出错等
+	ExitAuthFailed   = 2  // 没有可接受的认证方式或用户名/密码错误
+	ExitReplyBase    = 10 // 加上 REP 为退出码
+	ExitReplyUnknown = 19 // RFC 1928 未定义的 REP
+)
+
+// ExitError 带退出码的错误，main 以 Code 退出进程
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+
+func (e *ExitError) Unwrap() error { return e.Err }
+
+var connOpts = &ConnectOptions{}
+
+type ConnectOptions struct {
+	proxyAddr    string
+	username     string
+	password     string
+	passwordFile string
+	verbose      bool
+
+	handshakeTimeout time.Duration
+	dialTimeout      time.Duration
+}
+
+func (c *ConnectOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.proxyAddr, "proxy", "", "proxy address, host:port")
+	fs.StringVar(&c.username, "username", "", "username for the proxy's username/password auth")
+	fs.StringVar(&c.password, "password", "", "password for the proxy's username/password auth")
+	fs.StringVar(&c.passwordFile, "password-file", "", "file containing the password, trailing newline is ignored")
+	fs.BoolVar(&c.verbose, "verbose", false, "log the handshake to stderr")
+	fs.DurationVar(&c.handshakeTimeout, "handshake-timeout", 10*time.Second,
+		"max time for auth, request and reply with the proxy, 0 disables")
+	fs.DurationVar(&c.dialTimeout, "dial-timeout", 10*time.Second, "max time to connect to the proxy, 0 disables")
+}
+
+// ConnectCmd 经由 socks5 server 连接目标，然后在 stdin/stdout 与目标之间转发数据，
+// 可以用作 ssh 的 ProxyCommand，例如 ~/.ssh/config 中：
+//
+//	ProxyCommand so5 connect --proxy=127.0.0.1:1080 %h:%p
+var ConnectCmd = &cobra.Command{
+	Use:          "connect --proxy=<host:port> <target:port>",
+	Short:        "connect to target through the proxy and relay stdin/stdout, e.g. as ssh ProxyCommand",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if connOpts.proxyAddr == "" {
+			return &ExitError{Code: ExitFailed, Err: fmt.Errorf("usage: so5 connect --proxy=<host:port> <target:port>")}
+		}
+		// stdout 是转发的数据，stderr 通常直接显示给用户，默认不打印握手过程
+		if !connOpts.verbose {
+			log.SetOutput(io.Discard)
+		}
+
+		if err := connect(args[0]); err != nil {
+			return &ExitError{Code: exitCode(err), Err: err}
+		}
+		return nil
+	},
+}
+
+// connect 完成与 socks5 server 的握手，然后在 stdin/stdout 与 target 之间转发数据，直到目标关闭连接
+func connect(target string) error {
+	conn, err := dialTarget(target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// stdin 结束时半关闭，继续接收目标发来的数据
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+	}()
+
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
+
+// dialTarget 经由 --proxy 连接 target，服务端在回复之前关闭连接等情况都返回错误
+func dialTarget(target string) (net.Conn, error) {
+	auth, err := loadAuth("--", connOpts.username, connOpts.password, connOpts.passwordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &client.Dialer{ProxyAddr: connOpts.proxyAddr, Options: &client.Options{
+		Auth:             auth,
+		HandshakeTimeout: connOpts.handshakeTimeout,
+		DialTimeout:      connOpts.dialTimeout,
+	}}
+	return d.Dial("tcp", target)
+}
+
+// exitCode 根据握手失败的原因选择退出码
+func exitCode(err error) int {
+	var replyErr *client.ReplyError
+	var noMethod *client.NoAcceptableMethodError
+	switch {
+	case errors.As(err, &replyErr):
+		if replyErr.Rep > consts.RepAddrTypeUnsupported {
+			return ExitReplyUnknown
+		}
+		return ExitReplyBase + int(replyErr.Rep)
+	case errors.As(err, &noMethod), errors.Is(err, client.ErrAuthFailed):
+		return ExitAuthFailed
+	default:
+		return ExitFailed
+	}
+}
+
+func InitConnectCmd() {
+	connFs := pflag.NewFlagSet("connect", pflag.ExitOnError)
+	connOpts.AddFlags(connFs)
+	ConnectCmd.Flags().AddFlagSet(connFs)
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+)
+
+// startFakeProxy 启动只处理一个请求的 socks5 server：选择 method，读完请求后回复 rep，
+// rep 为负数时读完请求后直接关闭连接，不回复
+func startFakeProxy(t *testing.T, method byte, rep int) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var methods protocol.MethodRequest
+		if _, err := methods.ReadFrom(conn); err != nil {
+			return
+		}
+		sel := protocol.MethodSelection{Method: method}
+		if _, err := sel.WriteTo(conn); err != nil || method != consts.AuthTypeNoRequired {
+			return
+		}
+
+		var req protocol.Request
+		if _, err := req.ReadFrom(conn); err != nil || rep < 0 {
+			return
+		}
+		reply := protocol.Reply{Rep: byte(rep), Addr: protocol.Addr{Type: consts.AtypIPv4, Host: "0.0.0.0"}}
+		reply.WriteTo(conn)
+	}()
+
+	return lis.Addr().String()
+}
+
+func TestConnectExitCode(t *testing.T) {
+	type exitCase struct {
+		name   string
+		method byte
+		rep    int
+		want   int // 0 表示连接成功
+	}
+	tests := []exitCase{
+		{name: "success", rep: consts.RepSuccess},
+		{name: "no acceptable method", method: consts.AuthTypeNoAcceptable, want: ExitAuthFailed},
+		{name: "eof before reply", rep: -1, want: ExitFailed},
+		{name: "REP 0x09", rep: 0x09, want: ExitReplyUnknown},
+		{name: "REP 0xff", rep: 0xff, want: ExitReplyUnknown},
+	}
+	// RFC 1928 定义的每个失败的 REP
+	for rep := consts.RepFailed; rep <= consts.RepAddrTypeUnsupported; rep++ {
+		tests = append(tests, exitCase{name: fmt.Sprintf("REP %#x", rep), rep: rep, want: ExitReplyBase + rep})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connOpts = &ConnectOptions{proxyAddr: startFakeProxy(t, tt.method, tt.rep), handshakeTimeout: 3 * time.Second}
+
+			conn, err := dialTarget("127.0.0.1:22")
+			if tt.want == 0 {
+				if err != nil {
+					t.Fatalf("dialTarget error = %v, want nil", err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				conn.Close()
+				t.Fatalf("dialTarget error = nil, want exit code %d", tt.want)
+			}
+			if got := exitCode(err); got != tt.want {
+				t.Fatalf("exitCode(%v) = %d, want %d", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectDialFailed(t *testing.T) {
+	// 监听后立即关闭，得到一个没有人监听的端口
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	connOpts = &ConnectOptions{proxyAddr: lis.Addr().String(), dialTimeout: time.Second}
+
+	_, err = dialTarget("127.0.0.1:22")
+	if err == nil {
+		t.Fatal("dialTarget error = nil, want connection refused")
+	}
+	if got := exitCode(err); got != ExitFailed {
+		t.Fatalf("exitCode(%v) = %d, want %d", err, got, ExitFailed)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "auth failed", err: client.ErrAuthFailed, want: ExitAuthFailed},
+		{name: "wrapped reply", err: fmt.Errorf("dial: %w", &client.ReplyError{Rep: consts.RepHostUnreachable}), want: 14},
+		{name: "other", err: errors.New("boom"), want: ExitFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Fatalf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+
+			// ExitError 保留原来的错误
+			exitErr := &ExitError{Code: tt.want, Err: tt.err}
+			if exitErr.Error() != tt.err.Error() || !errors.Is(exitErr, tt.err) {
+				t.Fatalf("ExitError does not wrap %v", tt.err)
+			}
+		})
+	}
+}
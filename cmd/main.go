@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
+	"os"
+
 	"github.com/spf13/cobra"
 
 	"zz.io/cargo/so5/cmd/client"
 	"zz.io/cargo/so5/cmd/server"
+	"zz.io/cargo/so5/cmd/user"
 )
 
 var rootCmd = &cobra.Command{
@@ -13,13 +17,26 @@ var rootCmd = &cobra.Command{
 }
 
 // ./so5 server --listen-addr=127.0.0.1:8081
+// ./so5 user add alice --file=./users
+// ./so5 server --listen-addr=127.0.0.1:8081 --auth-methods=userpass --user-file=./users
 // ./so5 client --listen-addr=127.0.0.1:8080 --proxy-addr=127.0.0.1:8081 --target-addr=127.0.0.1:8083
+// ./so5 client --proxy-addr=127.0.0.1:8081 --forward=127.0.0.1:8080=127.0.0.1:8083 --forward=127.0.0.1:8090=127.0.0.1:8093
+// ./so5 client --dynamic --listen-addr=127.0.0.1:1080 --proxy-addr=127.0.0.1:8081
+// ./so5 server --listen-addr=0.0.0.0:8081 --auth-methods=userpass --user-file=./users --allow-remote-forward=alice:8022
+// ./so5 client --proxy-addr=example.com:8081 --username=alice --password-file=./pwd --remote-forward=0.0.0.0:8022=127.0.0.1:22
+// ./so5 connect --proxy=127.0.0.1:8081 127.0.0.1:22，可用作 ssh 的 ProxyCommand
 func main() {
 	client.InitCmd()
+	client.InitConnectCmd()
 	server.InitCmd()
+	user.InitCmd()
 
-	rootCmd.AddCommand(client.ClientCmd, server.ServerCmd)
+	rootCmd.AddCommand(client.ClientCmd, client.ConnectCmd, server.ServerCmd, user.UserCmd)
 	if err := rootCmd.Execute(); err != nil {
+		var exitErr *client.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		panic(err)
 	}
 }
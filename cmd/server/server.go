@@ -1,31 +1,202 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 	"zz.io/cargo/so5/server"
 )
 
 var svrOpts = &ServerOptions{}
 
 type ServerOptions struct {
-	ListenAddr string
+	ListenAddr       string
+	AuthMethods      []string
+	Users            []string
+	UserFile         string
+	LegacyUserPass   bool
+	RemoteForwards   []string
+	ShutdownTimeout  time.Duration
+	HandshakeTimeout time.Duration
+	DialTimeout      time.Duration
+	IdleTimeout      time.Duration
 }
 
 func (c *ServerOptions) AddFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&c.ListenAddr, "listen-addr", "", "")
+	fs.StringVar(&c.ListenAddr, "listen-addr", "", "listen address, e.g. 127.0.0.1:1080 or [::1]:1080")
+	fs.StringSliceVar(&c.AuthMethods, "auth-methods", []string{"none"},
+		"acceptable auth methods in order of preference: none, userpass")
+	fs.StringArrayVar(&c.Users, "user", nil, "username:password accepted by the userpass method, repeatable")
+	fs.StringVar(&c.UserFile, "user-file", "",
+		"htpasswd file (bcrypt or argon2id) used by the userpass method, reloaded on change, see so5 user")
+	fs.BoolVar(&c.LegacyUserPass, "accept-legacy-userpass", false,
+		"also accept username/password auth version 0x05 sent by older so5 clients, RFC 1929 uses 0x01")
+	fs.StringArrayVar(&c.RemoteForwards, "allow-remote-forward", nil,
+		"user:port or user:low-high (1-65535) that user may listen on for remote forwarding, * matches any user, repeatable, "+
+			"remote forwarding is disabled if not set")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"on SIGINT/SIGTERM, how long to wait for active connections before closing them")
+	fs.DurationVar(&c.HandshakeTimeout, "handshake-timeout", 10*time.Second,
+		"max time for a client to finish method negotiation, auth and request, 0 disables")
+	fs.DurationVar(&c.DialTimeout, "dial-timeout", 10*time.Second, "max time to connect to a CONNECT target, 0 disables")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 5*time.Minute,
+		"close a session after no data in either direction for this long, 0 disables")
+}
+
+// authenticators 将 --auth-methods 转换为服务端的认证方式列表
+func (c *ServerOptions) authenticators() ([]server.Authenticator, error) {
+	auths := make([]server.Authenticator, 0, len(c.AuthMethods))
+	for _, m := range c.AuthMethods {
+		switch m {
+		case "none":
+			auths = append(auths, server.NoAuth{})
+		case "userpass":
+			store, err := c.credentials()
+			if err != nil {
+				return nil, err
+			}
+			auths = append(auths, server.UserPassAuth{Store: store, AcceptLegacyVersion: c.LegacyUserPass})
+		default:
+			return nil, fmt.Errorf("unknown auth method: %v", m)
+		}
+	}
+	return auths, nil
+}
+
+// credentials 将 --user-file 或 --user 转换为用户名/密码的存储
+func (c *ServerOptions) credentials() (server.CredentialStore, error) {
+	switch {
+	case c.UserFile != "" && len(c.Users) > 0:
+		return nil, fmt.Errorf("--user and --user-file are mutually exclusive")
+	case c.UserFile != "":
+		return server.NewFileCredentials(c.UserFile)
+	case len(c.Users) == 0:
+		return nil, fmt.Errorf("auth method userpass requires --user-file or at least one --user")
+	}
+
+	creds := make(server.StaticCredentials, len(c.Users))
+	for _, u := range c.Users {
+		name, pwd, ok := strings.Cut(u, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid --user %q, want username:password", u)
+		}
+		creds[name] = pwd
+	}
+	return creds, nil
+}
+
+// closeAuths 释放认证方式持有的资源，例如 FileCredentials 监听文件变化的 goroutine
+func closeAuths(auths []server.Authenticator) {
+	for _, a := range auths {
+		if up, ok := a.(server.UserPassAuth); ok {
+			if c, ok := up.Store.(io.Closer); ok {
+				_ = c.Close()
+			}
+		}
+	}
+}
+
+// remoteForwardRule 一条 --allow-remote-forward 规则
+type remoteForwardRule struct {
+	user      string // * 表示任意用户
+	low, high int
+}
+
+// allowRemoteForward 将 --allow-remote-forward 转换为服务端的远程端口转发策略，未设置时返回 nil（不允许）
+func (c *ServerOptions) allowRemoteForward() (func(ctx context.Context, req *server.Request) bool, error) {
+	if len(c.RemoteForwards) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]remoteForwardRule, 0, len(c.RemoteForwards))
+	for _, r := range c.RemoteForwards {
+		user, ports, ok := strings.Cut(r, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid --allow-remote-forward %q, want user:port or user:low-high", r)
+		}
+		low, high, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			high = low
+		}
+		lo, err1 := strconv.ParseUint(low, 10, 16)
+		hi, err2 := strconv.ParseUint(high, 10, 16)
+		// 端口 0 会让服务端监听随机端口，不能出现在规则中
+		if err1 != nil || err2 != nil || lo == 0 || lo > hi {
+			return nil, fmt.Errorf("invalid --allow-remote-forward %q, want user:port or user:low-high", r)
+		}
+		rules = append(rules, remoteForwardRule{user: user, low: int(lo), high: int(hi)})
+	}
+
+	return func(ctx context.Context, req *server.Request) bool {
+		port, err := strconv.Atoi(req.DstPort)
+		if err != nil {
+			return false
+		}
+		for _, r := range rules {
+			if (r.user == "*" || r.user == req.Auth.Identity) && port >= r.low && port <= r.high {
+				return true
+			}
+		}
+		return false
+	}, nil
 }
 
 var ServerCmd = &cobra.Command{
 	Use: "server",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		log.Printf("%+v", svrOpts)
+		// 不打印 --user，避免密码出现在日志中
+		log.Printf("listen-addr: %v, auth-methods: %v", svrOpts.ListenAddr, svrOpts.AuthMethods)
 		if svrOpts.ListenAddr == "" {
-			return fmt.Errorf("usage: so5 server --listen-addr=<> ")
+			return fmt.Errorf("usage: so5 server --listen-addr=<> [--auth-methods=none,userpass] [--user-file=<> | --user=<name:password>]")
+		}
+		auths, err := svrOpts.authenticators()
+		if err != nil {
+			return err
+		}
+		defer closeAuths(auths)
+		allowRemote, err := svrOpts.allowRemoteForward()
+		if err != nil {
+			return err
+		}
+
+		srv := server.New(server.Config{
+			Auths:            auths,
+			HandshakeTimeout: svrOpts.HandshakeTimeout,
+			DialTimeout:      svrOpts.DialTimeout,
+			IdleTimeout:      svrOpts.IdleTimeout,
+
+			AllowRemoteForward: allowRemote,
+		})
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- srv.ListenAndServe(svrOpts.ListenAddr)
+		}()
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+		}
+
+		log.Printf("shutting down, waiting up to %v for active connections", svrOpts.ShutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), svrOpts.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v, remaining connections closed", err)
 		}
-		return server.ListenAndServer(svrOpts.ListenAddr)
+		return nil
 	},
 }
 
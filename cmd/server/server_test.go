@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"zz.io/cargo/so5/server"
+)
+
+func TestAllowRemoteForwardRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		wantErr bool
+	}{
+		{name: "not set"},
+		{name: "port", rules: []string{"alice:8022"}},
+		{name: "range", rules: []string{"alice:8000-8099", "*:9000"}},
+		{name: "full range", rules: []string{"*:1-65535"}},
+		{name: "malformed", rules: []string{"alice"}, wantErr: true},
+		{name: "missing user", rules: []string{":8022"}, wantErr: true},
+		{name: "missing port", rules: []string{"alice:"}, wantErr: true},
+		{name: "non-numeric port", rules: []string{"alice:ssh"}, wantErr: true},
+		{name: "non-numeric range", rules: []string{"alice:8000-high"}, wantErr: true},
+		{name: "low greater than high", rules: []string{"alice:8099-8000"}, wantErr: true},
+		{name: "port 0", rules: []string{"alice:0"}, wantErr: true},
+		{name: "range from 0", rules: []string{"alice:0-8000"}, wantErr: true},
+		{name: "port over 65535", rules: []string{"alice:65536"}, wantErr: true},
+		{name: "range over 65535", rules: []string{"alice:8000-70000"}, wantErr: true},
+		{name: "negative port", rules: []string{"alice:-1"}, wantErr: true},
+		{name: "one bad rule", rules: []string{"alice:8022", "bob"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &ServerOptions{RemoteForwards: tt.rules}
+			allow, err := opts.allowRemoteForward()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid --allow-remote-forward") {
+					t.Fatalf("allowRemoteForward(%q) error = %v, want invalid rule", tt.rules, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("allowRemoteForward(%q) error = %v", tt.rules, err)
+			}
+			// 未设置时不允许远程端口转发
+			if (allow == nil) != (len(tt.rules) == 0) {
+				t.Fatalf("allowRemoteForward(%q) returned nil = %v", tt.rules, allow == nil)
+			}
+		})
+	}
+}
+
+func TestAllowRemoteForwardMatch(t *testing.T) {
+	opts := &ServerOptions{RemoteForwards: []string{"alice:8000-8099", "bob:9000", "*:7000"}}
+	allow, err := opts.allowRemoteForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		identity string
+		port     string
+		want     bool
+	}{
+		{name: "range low", identity: "alice", port: "8000", want: true},
+		{name: "range high", identity: "alice", port: "8099", want: true},
+		{name: "below range", identity: "alice", port: "7999"},
+		{name: "above range", identity: "alice", port: "8100"},
+		{name: "single port", identity: "bob", port: "9000", want: true},
+		{name: "other user's port", identity: "bob", port: "8000"},
+		{name: "wildcard", identity: "carol", port: "7000", want: true},
+		{name: "wildcard other port", identity: "carol", port: "9000"},
+		// NoAuth 的会话身份为空，不能匹配指定了用户的规则，只能匹配 *
+		{name: "no auth named user", identity: "", port: "8000"},
+		{name: "no auth wildcard", identity: "", port: "7000", want: true},
+		{name: "port 0", identity: "alice", port: "0"},
+		{name: "non-numeric port", identity: "alice", port: "http"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &server.Request{DstAddr: "0.0.0.0", DstPort: tt.port, Auth: server.AuthInfo{Identity: tt.identity}}
+			if got := allow(context.Background(), req); got != tt.want {
+				t.Fatalf("allow(identity %q, port %v) = %v, want %v", tt.identity, tt.port, got, tt.want)
+			}
+		})
+	}
+
+	// * 匹配任意用户
+	anyPort := &ServerOptions{RemoteForwards: []string{"*:1-65535"}}
+	allowAll, err := anyPort.allowRemoteForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []int{1, 65535} {
+		for _, identity := range []string{"", "alice"} {
+			req := &server.Request{DstPort: strconv.Itoa(port), Auth: server.AuthInfo{Identity: identity}}
+			if !allowAll(context.Background(), req) {
+				t.Fatalf("*:1-65535 does not allow identity %q port %d", identity, port)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package user
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/term"
+
+	"zz.io/cargo/so5/htpasswd"
+)
+
+var userOpts = &UserOptions{}
+
+type UserOptions struct {
+	file          string
+	hash          string
+	passwordStdin bool
+}
+
+func (c *UserOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.file, "file", "", "htpasswd file used by so5 server --user-file")
+	fs.StringVar(&c.hash, "hash", htpasswd.Bcrypt, "password hash algorithm: bcrypt, argon2id")
+	fs.BoolVar(&c.passwordStdin, "password-stdin", false, "read the password from stdin instead of prompting")
+}
+
+// so5 user add alice --file=/etc/so5/users
+// so5 user passwd alice --file=/etc/so5/users --hash=argon2id
+// so5 user remove alice --file=/etc/so5/users
+var UserCmd = &cobra.Command{
+	Use:   "user",
+	Short: "manage users in the htpasswd file used by so5 server",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if userOpts.file == "" {
+			return fmt.Errorf("usage: so5 user add|remove|passwd <username> --file=<>")
+		}
+		return nil
+	},
+}
+
+var addCmd = &cobra.Command{
+	Use:  "add <username>",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setPassword(args[0], false)
+	},
+}
+
+var passwdCmd = &cobra.Command{
+	Use:  "passwd <username>",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setPassword(args[0], true)
+	},
+}
+
+var removeCmd = &cobra.Command{
+	Use:  "remove <username>",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return htpasswd.Edit(userOpts.file, func(f *htpasswd.File) error {
+			return f.Remove(args[0])
+		})
+	},
+}
+
+// setPassword 添加用户（mustExist 为 false）或修改已有用户的密码（mustExist 为 true）
+func setPassword(username string, mustExist bool) error {
+	pwd, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	hash, err := htpasswd.Hash(userOpts.hash, pwd)
+	if err != nil {
+		return err
+	}
+
+	return htpasswd.Edit(userOpts.file, func(f *htpasswd.File) error {
+		switch exist := f.Has(username); {
+		case mustExist && !exist:
+			return fmt.Errorf("user %v does not exist, use so5 user add", username)
+		case !mustExist && exist:
+			return fmt.Errorf("user %v already exists, use so5 user passwd", username)
+		}
+		return f.Set(username, hash)
+	})
+}
+
+// readPassword 终端下提示输入两次密码且不回显，否则从 stdin 读取一行
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if userOpts.passwordStdin || !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("read password from stdin error: %+v", err)
+		}
+		return checkPassword(strings.TrimRight(line, "\r\n"))
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	pwd, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Retype new password: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(pwd) != string(again) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return checkPassword(string(pwd))
+}
+
+// checkPassword RFC 1929 中密码最长 255 字节
+func checkPassword(pwd string) (string, error) {
+	if pwd == "" || len(pwd) > 255 {
+		return "", fmt.Errorf("password length must be between 1 and 255 bytes")
+	}
+	return pwd, nil
+}
+
+func InitCmd() {
+	userFs := pflag.NewFlagSet("user", pflag.ExitOnError)
+	userOpts.AddFlags(userFs)
+	UserCmd.PersistentFlags().AddFlagSet(userFs)
+	UserCmd.AddCommand(addCmd, passwdCmd, removeCmd)
+}
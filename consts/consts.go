@@ -7,18 +7,39 @@ const (
 )
 
 const (
-	RepSuccess = 0x00 // 代理服务器到目的服务器的连接建立成功
-	RepFailed  = 0x01 // 代理服务器到目的服务器的连接建立失败,这里粗略的用 1 代表所有错误情况，实际细分了很多种
+	RepSuccess             = 0x00 // 代理服务器到目的服务器的连接建立成功
+	RepFailed              = 0x01 // 普通的 SOCKS 服务器请求失败，无法细分的错误都使用该值
+	RepNotAllowed          = 0x02 // 现有的规则不允许的连接
+	RepNetworkUnreachable  = 0x03 // 网络不可达
+	RepHostUnreachable     = 0x04 // 主机不可达
+	RepConnectionRefused   = 0x05 // 连接被拒
+	RepTTLExpired          = 0x06 // TTL 超时
+	RepCmdNotSupported     = 0x07 // 不支持的命令
+	RepAddrTypeUnsupported = 0x08 // 不支持的地址类型
+)
+
+const (
 	CmdConnect = 0x01
-	CmdBind    = 0x02 // not support
-	CmdUdp     = 0x03 // not support
+	CmdBind    = 0x02
+	CmdUdp     = 0x03
 	RSV        = 0x00 // 保留字段
 )
 
+// so5 私有的 CMD（RFC 1928 未定义，使用 0x80 以上的值），用于远程端口转发
 const (
-	Version      = 0x05 // socket5 ver 的默认值
-	AuthUserOk   = 0x00 // 用户验证成功
-	AuthUserFail = 0x01 // 用户验证失败（非 0）
+	// CmdRemoteListen 请求服务端在 DST.ADDR:DST.PORT 上监听，回复的 BND 为实际监听的地址；
+	// 之后每连入一个连接，服务端在同一连接上再发送一个回复，BND 为连入方的地址
+	CmdRemoteListen = 0x80
+	// CmdRemoteAccept 在新的连接上认领 DST.ADDR:DST.PORT（上面通知的连入方地址）的连接，
+	// 回复成功后开始在两者之间转发数据
+	CmdRemoteAccept = 0x81
+)
+
+const (
+	Version         = 0x05 // socket5 ver 的默认值
+	UserPassVersion = 0x01 // 用户名/密码子协商的版本号（RFC 1929），与 socks 的版本号不同
+	AuthUserOk      = 0x00 // 用户验证成功
+	AuthUserFail    = 0x01 // 用户验证失败（非 0）
 )
 
 // 服务端支持的认证方式
@@ -27,3 +48,13 @@ const (
 	AuthTypeUnamePwd          = 0x02 // 使用用户名/密码进行认证
 	AuthTypeNoAcceptable      = 0xff // 客户端不支持服务端的认证方法
 )
+
+// SOCKS4/4a（参见 https://www.openssh.com/txt/socks4.protocol 和 socks4a.protocol）
+const (
+	Socks4Version           = 0x04 // 请求中的 VN
+	Socks4ReplyVersion      = 0x00 // 回复中的 VN
+	Socks4RepGranted        = 0x5a // 90，请求成功
+	Socks4RepRejected       = 0x5b // 91，请求被拒绝或失败
+	Socks4RepNoIdentd       = 0x5c // 92，无法连接客户端的 identd
+	Socks4RepUserIDMismatch = 0x5d // 93，identd 返回的用户与 USERID 不一致
+)
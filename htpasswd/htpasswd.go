@@ -0,0 +1,362 @@
+// Package htpasswd 读写 htpasswd 格式的用户文件，每行一个用户：
+//
+//	username:hash
+//
+// hash 支持 bcrypt（$2a$、$2b$、$2y$，与 Apache htpasswd -B 兼容）
+// 以及 argon2id（PHC 格式，$argon2id$v=19$m=...,t=...,p=...$salt$key）。
+// 以 # 开头的行和空行会被忽略。
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 支持的 hash 算法
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// argon2id 的默认参数，参见 RFC 9106 4. Parameter Choice
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// argon2Concurrency 同时进行的 argon2id 计算的上限。每次计算占用 m KiB 内存（默认 64 MiB），
+// 认证发生在客户端通过认证之前，不加限制时未认证的客户端可以通过并发的认证请求耗尽服务端内存
+const argon2Concurrency = 4
+
+var argon2Sem = make(chan struct{}, argon2Concurrency)
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrInvalidUser    = errors.New("username must not be empty or contain ':' or newline")
+	ErrUnsupportedAlg = errors.New("unsupported hash algorithm")
+)
+
+// Entry 文件中的一个用户
+type Entry struct {
+	User string
+	Hash string
+}
+
+// File htpasswd 文件的内容，保留用户的先后顺序，便于编辑后写回
+type File struct {
+	entries []Entry
+}
+
+// Load 读取并解析 path 指定的文件
+func Load(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse 从 r 中解析 htpasswd 内容
+func Parse(r io.Reader) (*File, error) {
+	file := &File{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("htpasswd line %d: invalid entry", lineNo)
+		}
+		file.entries = append(file.entries, Entry{User: user, Hash: hash})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Entries 返回文件中的所有用户
+func (f *File) Entries() []Entry {
+	return append([]Entry(nil), f.entries...)
+}
+
+// Verify 校验用户名和密码，用户不存在时同样会进行一次 hash 计算，避免通过耗时判断用户是否存在
+func (f *File) Verify(user, password string) bool {
+	for _, e := range f.entries {
+		if e.User == user {
+			return VerifyHash(e.Hash, password)
+		}
+	}
+
+	_ = VerifyHash(f.dummyHash(), password)
+	return false
+}
+
+// dummyHash 返回用户不存在时用于校验的 hash：文件中占多数的算法的第一个 hash，
+// 与存在的用户使用相同的算法和参数（cost、m/t/p），耗时相近。文件中没有可识别的 hash 时使用 defaultDummyHash
+func (f *File) dummyHash() string {
+	first := make(map[string]string, 2)
+	count := make(map[string]int, 2)
+	for _, e := range f.entries {
+		alg := hashAlg(e.Hash)
+		if alg == "" {
+			continue
+		}
+		if count[alg] == 0 {
+			first[alg] = e.Hash
+		}
+		count[alg]++
+	}
+
+	switch {
+	case count[Argon2id] > count[Bcrypt]:
+		return first[Argon2id]
+	case count[Bcrypt] > 0:
+		return first[Bcrypt]
+	default:
+		return defaultDummyHash
+	}
+}
+
+// Has 判断用户是否存在
+func (f *File) Has(user string) bool {
+	for _, e := range f.entries {
+		if e.User == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Set 添加用户，用户已存在时更新其 hash
+func (f *File) Set(user, hash string) error {
+	if user == "" || strings.ContainsAny(user, ":\r\n") {
+		return ErrInvalidUser
+	}
+
+	for i := range f.entries {
+		if f.entries[i].User == user {
+			f.entries[i].Hash = hash
+			return nil
+		}
+	}
+	f.entries = append(f.entries, Entry{User: user, Hash: hash})
+	return nil
+}
+
+// Remove 删除用户
+func (f *File) Remove(user string) error {
+	for i, e := range f.entries {
+		if e.User == user {
+			f.entries = append(f.entries[:i], f.entries[i+1:]...)
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+// WriteTo 以 htpasswd 格式输出所有用户
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, e := range f.entries {
+		buf.WriteString(e.User)
+		buf.WriteByte(':')
+		buf.WriteString(e.Hash)
+		buf.WriteByte('\n')
+	}
+	return buf.WriteTo(w)
+}
+
+// Save 将内容写回 path：先写入同目录下的临时文件再 rename，
+// 保证读取方（例如正在监听文件变化的服务端）不会读到写了一半的文件
+func (f *File) Save(path string) error {
+	mode := os.FileMode(0o600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := f.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Edit 在文件锁的保护下读取 path，调用 fn 修改后写回，path 不存在时从空文件开始，
+// 用于避免多个进程同时编辑同一个文件时互相覆盖
+func Edit(path string, fn func(f *File) error) error {
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := Load(path)
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = &File{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := fn(f); err != nil {
+		return err
+	}
+	return f.Save(path)
+}
+
+// lockTimeout 等待其他进程释放文件锁的最长时间
+const lockTimeout = 5 * time.Second
+
+// lock 通过独占创建 path.lock 实现跨进程的文件锁
+func lock(path string) (unlock func(), err error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%v is locked by another process, remove it if stale", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Hash 使用 alg 指定的算法计算密码的 hash
+func Hash(alg, password string) (string, error) {
+	switch alg {
+	case Bcrypt:
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	case Argon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2Key([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", ErrUnsupportedAlg
+	}
+}
+
+// VerifyHash 校验密码与 hash 是否匹配，根据 hash 的前缀判断算法
+func VerifyHash(hash, password string) bool {
+	switch hashAlg(hash) {
+	case Bcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case Argon2id:
+		return verifyArgon2id(hash, password)
+	default:
+		return false
+	}
+}
+
+// hashAlg 根据 hash 的前缀判断算法，不支持的算法返回空字符串
+func hashAlg(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return Bcrypt
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2id
+	default:
+		return ""
+	}
+}
+
+// verifyArgon2id 校验 PHC 格式的 argon2id hash：$argon2id$v=19$m=65536,t=3,p=4$salt$key
+func verifyArgon2id(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	if iterations == 0 || threads == 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	got := argon2Key([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
+
+// argon2Key 计算 argon2id，同时进行的计算不超过 argon2Concurrency 个，其余的排队等待
+func argon2Key(password, salt []byte, iterations, memory uint32, threads uint8, keyLen uint32) []byte {
+	argon2Sem <- struct{}{}
+	defer func() { <-argon2Sem }()
+
+	return argon2.IDKey(password, salt, iterations, memory, threads, keyLen)
+}
+
+// defaultDummyHash 文件中没有可识别的 hash 时用于消耗与正常校验相近的时间，cost 与 bcrypt.DefaultCost 相同
+const defaultDummyHash = "$2a$10$syVZPoAQhkPzD0W1ajeIxerIUGVBm3Zq2qtu2FT/4cKYHgdshrJzC"
@@ -0,0 +1,229 @@
+package htpasswd
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func mustHash(t *testing.T, alg, password string) string {
+	t.Helper()
+	hash, err := Hash(alg, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestVerify(t *testing.T) {
+	f := &File{}
+	for _, e := range []Entry{
+		{User: "alice", Hash: mustHash(t, Bcrypt, "alice-pw")},
+		{User: "bob", Hash: mustHash(t, Argon2id, "bob-pw")},
+		{User: "carol", Hash: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+	} {
+		if err := f.Set(e.User, e.Hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     bool
+	}{
+		{name: "bcrypt", user: "alice", password: "alice-pw", want: true},
+		{name: "bcrypt wrong password", user: "alice", password: "bob-pw"},
+		{name: "argon2id", user: "bob", password: "bob-pw", want: true},
+		{name: "argon2id wrong password", user: "bob", password: "alice-pw"},
+		{name: "unsupported hash", user: "carol", password: "password"},
+		{name: "unknown user", user: "dave", password: "alice-pw"},
+		{name: "empty password", user: "alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.Verify(tt.user, tt.password); got != tt.want {
+				t.Fatalf("Verify(%q, %q) = %v, want %v", tt.user, tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyHashMalformed(t *testing.T) {
+	valid := mustHash(t, Argon2id, "pw")
+	parts := strings.Split(valid, "$")
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{name: "empty", hash: ""},
+		{name: "bcrypt truncated", hash: "$2a$10$short"},
+		{name: "argon2id missing key", hash: strings.Join(parts[:5], "$")},
+		{name: "argon2id wrong version", hash: strings.Replace(valid, "v=19", "v=16", 1)},
+		{name: "argon2id bad params", hash: strings.Replace(valid, parts[3], "m=x,t=3,p=4", 1)},
+		{name: "argon2id zero iterations", hash: strings.Replace(valid, parts[3], "m=65536,t=0,p=4", 1)},
+		{name: "argon2id bad salt", hash: strings.Replace(valid, parts[4], "!!!", 1)},
+		{name: "argon2i", hash: strings.Replace(valid, "$argon2id$", "$argon2i$", 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if VerifyHash(tt.hash, "pw") {
+				t.Fatalf("VerifyHash(%q) = true, want false", tt.hash)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	f, err := Parse(strings.NewReader("# comment\n\n  alice:$2a$10$x  \nbob:$argon2id$v=19$x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{User: "alice", Hash: "$2a$10$x"}, {User: "bob", Hash: "$argon2id$v=19$x"}}
+	got := f.Entries()
+	if len(got) != len(want) {
+		t.Fatalf("Entries() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Entries()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, content := range []string{
+		"alice",
+		"alice:",
+		":$2a$10$x",
+		"alice:$2a$10$x\nbob\n",
+	} {
+		if _, err := Parse(strings.NewReader(content)); err == nil {
+			t.Fatalf("Parse(%q) = nil error, want invalid entry", content)
+		}
+	}
+}
+
+func TestSetRemove(t *testing.T) {
+	f := &File{}
+	for _, user := range []string{"", "a:b", "a\nb"} {
+		if err := f.Set(user, "$2a$10$x"); !errors.Is(err, ErrInvalidUser) {
+			t.Fatalf("Set(%q) = %v, want %v", user, err, ErrInvalidUser)
+		}
+	}
+
+	if err := f.Set("alice", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("alice", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if entries := f.Entries(); len(entries) != 1 || entries[0].Hash != "new" {
+		t.Fatalf("Entries() = %v, want alice updated in place", entries)
+	}
+
+	if err := f.Remove("bob"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Remove(bob) = %v, want %v", err, ErrUserNotFound)
+	}
+	if err := f.Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Has("alice") {
+		t.Fatal("Has(alice) = true after Remove")
+	}
+}
+
+// TestEditReload Edit 写回后重新 Load 得到修改后的内容，并发的 Edit 互不覆盖
+func TestEditReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+
+	users := []string{"u0", "u1", "u2", "u3", "u4", "u5", "u6", "u7"}
+	var wg sync.WaitGroup
+	for _, user := range users {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			if err := Edit(path, func(f *File) error { return f.Set(user, "$2a$10$"+user) }); err != nil {
+				t.Error(err)
+			}
+		}(user)
+	}
+	wg.Wait()
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		if !f.Has(user) {
+			t.Fatalf("user %v lost after concurrent Edit", user)
+		}
+	}
+
+	if err := Edit(path, func(f *File) error { return f.Remove("u0") }); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if f.Has("u0") || len(f.Entries()) != len(users)-1 {
+		t.Fatalf("Entries() after Remove = %v", f.Entries())
+	}
+}
+
+// TestDummyHash 用户不存在时使用文件中占多数的算法校验
+func TestDummyHash(t *testing.T) {
+	const (
+		b = "$2a$10$bcrypt"
+		a = "$argon2id$v=19$argon2"
+	)
+	tests := []struct {
+		name   string
+		hashes []string
+		want   string
+	}{
+		{name: "empty", want: defaultDummyHash},
+		{name: "unsupported only", hashes: []string{"{SHA}x"}, want: defaultDummyHash},
+		{name: "bcrypt", hashes: []string{b, a}, want: b},
+		{name: "argon2id", hashes: []string{b, a, a + "2"}, want: a},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &File{}
+			for i, h := range tt.hashes {
+				f.entries = append(f.entries, Entry{User: string(rune('a' + i)), Hash: h})
+			}
+			if got := f.dummyHash(); got != tt.want {
+				t.Fatalf("dummyHash() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestArgon2Concurrency 并发的 argon2id 校验排队进行，结果不受影响
+func TestArgon2Concurrency(t *testing.T) {
+	hash := mustHash(t, Argon2id, "pw")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2*argon2Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !VerifyHash(hash, "pw") {
+				t.Error("VerifyHash = false, want true")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(argon2Sem); n != 0 {
+		t.Fatalf("%d argon2 slots still held", n)
+	}
+}
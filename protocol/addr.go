@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/util/pool"
+)
+
+// ErrAtypNotSupported ATYP 不是 IPv4、域名、IPv6 中的任意一种
+var ErrAtypNotSupported = errors.New("invalid atyp")
+
+// Addr 请求、回复以及 UDP 头部中的地址部分：
+// +------+----------+----------+
+// | ATYP |   ADDR   |   PORT   |
+// +------+----------+----------+
+// |  1   | Variable |    2     |
+// +------+----------+----------+
+//
+// ATYP	地址类型，0x01=IPv4，0x03=域名（第一个字节为长度，没有 0 结尾），0x04=IPv6
+type Addr struct {
+	Type byte   // ATYP
+	Host string // IPv4、IPv6（不带方括号）或域名
+	Port uint16
+}
+
+// ParseAddr 将 host:port 转换为 Addr，host 为域名时使用 ATYP 0x03，
+// IPv4-mapped IPv6 地址（::ffff:a.b.c.d）按 IPv4 处理，zone 只在本机有意义，会被丢弃
+func ParseAddr(hostport string) (Addr, error) {
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return Addr{}, err
+	}
+
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return Addr{}, fmt.Errorf("invalid port %q", p)
+	}
+
+	if IsDomainName(host) {
+		return Addr{Type: consts.AtypDomain, Host: host, Port: uint16(port)}, nil
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return Addr{}, err
+	}
+	ip = ip.Unmap().WithZone("")
+
+	atyp := byte(consts.AtypIpv6)
+	if ip.Is4() {
+		atyp = consts.AtypIPv4
+	}
+	return Addr{Type: atyp, Host: ip.String(), Port: uint16(port)}, nil
+}
+
+// AddrFromNet 根据 *net.TCPAddr 或 *net.UDPAddr 构造 Addr，其他情况（包括 nil）返回 0.0.0.0:0
+func AddrFromNet(addr net.Addr) Addr {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return Addr{Type: consts.AtypIPv4, Host: ip4.String(), Port: uint16(port)}
+	}
+	if len(ip) == net.IPv6len {
+		return Addr{Type: consts.AtypIpv6, Host: ip.String(), Port: uint16(port)}
+	}
+	return Addr{Type: consts.AtypIPv4, Host: "0.0.0.0"}
+}
+
+// String 返回 host:port，IPv6 带方括号
+func (a Addr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+}
+
+// appendBinary 将 ATYP、ADDR、PORT 追加到 b 后面
+func (a Addr) appendBinary(b []byte) ([]byte, error) {
+	b = append(b, a.Type)
+
+	switch a.Type {
+	case consts.AtypIPv4:
+		ip, err := netip.ParseAddr(a.Host)
+		if err != nil || !ip.Unmap().Is4() {
+			return nil, fmt.Errorf("invalid IPv4 address %q", a.Host)
+		}
+		ip4 := ip.Unmap().As4()
+		b = append(b, ip4[:]...)
+	case consts.AtypDomain:
+		if len(a.Host) > 255 {
+			return nil, fmt.Errorf("domain too long: %d", len(a.Host))
+		}
+		b = append(b, byte(len(a.Host)))
+		b = append(b, a.Host...)
+	case consts.AtypIpv6:
+		ip, err := netip.ParseAddr(a.Host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", a.Host)
+		}
+		ip16 := ip.As16()
+		b = append(b, ip16[:]...)
+	default:
+		return nil, ErrAtypNotSupported
+	}
+
+	return binary.BigEndian.AppendUint16(b, a.Port), nil
+}
+
+// readFrom 依次读取 ATYP、ADDR、PORT
+func (a *Addr) readFrom(r io.Reader) (int64, error) {
+	bp := pool.ByteSlice2.Get().(*[]byte)
+	defer pool.ByteSlice2.Put(bp)
+	b := *bp
+
+	n, err := io.ReadFull(r, b[:1])
+	if err != nil {
+		return int64(n), fmt.Errorf("read ATYP error: %w", err)
+	}
+	atyp := b[0]
+
+	host, hn, err := readHost(r, atyp)
+	if err != nil {
+		return int64(n + hn), err
+	}
+
+	port, pn, err := readPort(r)
+	if err != nil {
+		return int64(n + hn + pn), err
+	}
+
+	*a = Addr{Type: atyp, Host: host, Port: port}
+	return int64(n + hn + pn), nil
+}
+
+// ReadHost 根据已经读出的 ATYP 从 r 中读取 ADDR
+func ReadHost(r io.Reader, atyp byte) (string, error) {
+	host, _, err := readHost(r, atyp)
+	return host, err
+}
+
+// ReadPort 从 r 中读取网络字节序的 PORT
+func ReadPort(r io.Reader) (uint16, error) {
+	port, _, err := readPort(r)
+	return port, err
+}
+
+func readHost(r io.Reader, atyp byte) (host string, n int, err error) {
+	bp := pool.ByteSlice255.Get().(*[]byte)
+	defer pool.ByteSlice255.Put(bp)
+	b := *bp
+
+	switch atyp {
+	case consts.AtypIPv4:
+		n, err = io.ReadFull(r, b[:net.IPv4len])
+		if err != nil {
+			return "", n, fmt.Errorf("parse atyp 0x01 [IPv4] addr error: %w", err)
+		}
+		return netip.AddrFrom4([4]byte(b[:net.IPv4len])).String(), n, nil
+	case consts.AtypDomain:
+		n, err = io.ReadFull(r, b[:1])
+		if err != nil {
+			return "", n, fmt.Errorf("read atyp 0x03 [domain] len error: %w", err)
+		}
+		domainLen := int(b[0])
+
+		m, err := io.ReadFull(r, b[:domainLen])
+		n += m
+		if err != nil {
+			return "", n, fmt.Errorf("parse atyp 0x03 [domain] addr error: %w", err)
+		}
+		return string(b[:domainLen]), n, nil
+	case consts.AtypIpv6:
+		n, err = io.ReadFull(r, b[:net.IPv6len])
+		if err != nil {
+			return "", n, fmt.Errorf("parse atyp 0x04 [IPv6] addr error: %w", err)
+		}
+		return net.IP(b[:net.IPv6len]).String(), n, nil
+	default:
+		return "", 0, ErrAtypNotSupported
+	}
+}
+
+func readPort(r io.Reader) (port uint16, n int, err error) {
+	bp := pool.ByteSlice2.Get().(*[]byte)
+	defer pool.ByteSlice2.Put(bp)
+	b := *bp
+
+	n, err = io.ReadFull(r, b)
+	if err != nil {
+		return 0, n, fmt.Errorf("parse port error: %w", err)
+	}
+	return binary.BigEndian.Uint16(b), n, nil
+}
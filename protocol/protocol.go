@@ -0,0 +1,336 @@
+// Package protocol 定义 SOCKS5 的报文（RFC 1928、RFC 1929）以及它们的编码和解码，服务端和客户端共用。
+//
+// 每种报文都实现了 MarshalBinary、ReadFrom(io.Reader) 和 WriteTo(io.Writer)：
+// ReadFrom 只读取一个完整的报文，不会多读；报文中的保留字段（RSV）必须为 0。
+package protocol
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/util/pool"
+)
+
+var (
+	// ErrInvalidVersion VER 不是 0x05
+	ErrInvalidVersion = errors.New("invalid version")
+	// ErrInvalidRSV 保留字段不为 0
+	ErrInvalidRSV = errors.New("invalid RSV")
+)
+
+// MethodRequest 客户端发送的方法协商请求：
+// +----+----------+----------+
+// |VER | NMETHODS | METHODS  |
+// +----+----------+----------+
+// | 1  |    1     | 1 to 255 |
+// +----+----------+----------+
+type MethodRequest struct {
+	// Methods 客户端支持的认证方式，ReadFrom 会复用它的底层数组
+	Methods []byte
+}
+
+func (m *MethodRequest) MarshalBinary() ([]byte, error) {
+	if len(m.Methods) > 255 {
+		return nil, fmt.Errorf("too many methods: %d", len(m.Methods))
+	}
+	b := []byte{consts.Version, byte(len(m.Methods))}
+	return append(b, m.Methods...), nil
+}
+
+func (m *MethodRequest) ReadFrom(r io.Reader) (int64, error) {
+	bp := pool.ByteSlice2.Get().(*[]byte)
+	defer pool.ByteSlice2.Put(bp)
+	b := *bp
+
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return int64(n), fmt.Errorf("read header[ver, nmethods] error: %w", err)
+	}
+	if b[0] != consts.Version {
+		return int64(n), ErrInvalidVersion
+	}
+
+	methods := slices.Grow(m.Methods[:0], int(b[1]))[:b[1]]
+	mn, err := io.ReadFull(r, methods)
+	n += mn
+	if err != nil {
+		return int64(n), fmt.Errorf("read methods error: %w", err)
+	}
+
+	m.Methods = methods
+	return int64(n), nil
+}
+
+func (m *MethodRequest) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// MethodSelection 服务端选定的认证方式，0xFF 表示没有可接受的方式：
+// +----+--------+
+// |VER | METHOD |
+// +----+--------+
+// | 1  |   1    |
+// +----+--------+
+type MethodSelection struct {
+	Method byte
+}
+
+func (m *MethodSelection) MarshalBinary() ([]byte, error) {
+	return []byte{consts.Version, m.Method}, nil
+}
+
+func (m *MethodSelection) ReadFrom(r io.Reader) (int64, error) {
+	bp := pool.ByteSlice2.Get().(*[]byte)
+	defer pool.ByteSlice2.Put(bp)
+	b := *bp
+
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return int64(n), fmt.Errorf("read method selection error: %w", err)
+	}
+	if b[0] != consts.Version {
+		return int64(n), ErrInvalidVersion
+	}
+
+	m.Method = b[1]
+	return int64(n), nil
+}
+
+func (m *MethodSelection) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// UserPassRequest 用户名/密码认证的请求（RFC 1929）：
+// +----+------+----------+------+----------+
+// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+// +----+------+----------+------+----------+
+// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+// +----+------+----------+------+----------+
+//
+// 子协商的版本号由调用方检查
+type UserPassRequest struct {
+	Version  byte
+	Username string
+	Password string
+}
+
+func (m *UserPassRequest) MarshalBinary() ([]byte, error) {
+	if len(m.Username) > 255 || len(m.Password) > 255 {
+		return nil, fmt.Errorf("username or password too long")
+	}
+
+	b := make([]byte, 0, 3+len(m.Username)+len(m.Password))
+	b = append(b, m.Version, byte(len(m.Username)))
+	b = append(b, m.Username...)
+	b = append(b, byte(len(m.Password)))
+	b = append(b, m.Password...)
+	return b, nil
+}
+
+func (m *UserPassRequest) ReadFrom(r io.Reader) (int64, error) {
+	bp := pool.ByteSlice255.Get().(*[]byte)
+	defer pool.ByteSlice255.Put(bp)
+	b := *bp
+
+	// 读取 VER 和 ULEN
+	n, err := io.ReadFull(r, b[:2])
+	if err != nil {
+		return int64(n), fmt.Errorf("read header[VER, ULEN] error: %w", err)
+	}
+	ver, ulen := b[0], int(b[1])
+
+	// 读取 USERNAME
+	un, err := io.ReadFull(r, b[:ulen])
+	n += un
+	if err != nil {
+		return int64(n), fmt.Errorf("read USERNAME error: %w", err)
+	}
+	uname := string(b[:ulen])
+
+	// 读取 PLEN
+	pn, err := io.ReadFull(r, b[:1])
+	n += pn
+	if err != nil {
+		return int64(n), fmt.Errorf("read PLEN error: %w", err)
+	}
+	plen := int(b[0])
+
+	// 读取 PASSWORD
+	pn, err = io.ReadFull(r, b[:plen])
+	n += pn
+	if err != nil {
+		return int64(n), fmt.Errorf("read PASSWD error: %w", err)
+	}
+
+	*m = UserPassRequest{Version: ver, Username: uname, Password: string(b[:plen])}
+	return int64(n), nil
+}
+
+func (m *UserPassRequest) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// UserPassStatus 用户名/密码认证的结果，STATUS 为 0x00 表示成功，其余值表示失败：
+// +----+--------+
+// |VER | STATUS |
+// +----+--------+
+// | 1  |   1    |
+// +----+--------+
+type UserPassStatus struct {
+	Version byte
+	Status  byte
+}
+
+func (m *UserPassStatus) MarshalBinary() ([]byte, error) {
+	return []byte{m.Version, m.Status}, nil
+}
+
+func (m *UserPassStatus) ReadFrom(r io.Reader) (int64, error) {
+	bp := pool.ByteSlice2.Get().(*[]byte)
+	defer pool.ByteSlice2.Put(bp)
+	b := *bp
+
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return int64(n), fmt.Errorf("read auth status error: %w", err)
+	}
+
+	m.Version, m.Status = b[0], b[1]
+	return int64(n), nil
+}
+
+func (m *UserPassStatus) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// Request 客户端的请求：
+// +----+-----+-------+------+----------+----------+
+// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+// +----+-----+-------+------+----------+----------+
+// | 1  |  1  | X'00' |  1   | Variable |    2     |
+// +----+-----+-------+------+----------+----------+
+type Request struct {
+	Cmd  byte // 0x01=CONNECT, 0x02=BIND, 0x03=UDP ASSOCIATE
+	Addr Addr // DST.ADDR、DST.PORT
+}
+
+func (m *Request) MarshalBinary() ([]byte, error) {
+	return m.Addr.appendBinary([]byte{consts.Version, m.Cmd, consts.RSV})
+}
+
+func (m *Request) ReadFrom(r io.Reader) (int64, error) {
+	n, cmd, err := readHeader(r, "VER, CMD, RSV")
+	if err != nil {
+		return n, err
+	}
+
+	an, err := m.Addr.readFrom(r)
+	n += an
+	if err != nil {
+		return n, err
+	}
+
+	m.Cmd = cmd
+	return n, nil
+}
+
+func (m *Request) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// Reply 服务端对请求的回复：
+// +----+-----+-------+------+----------+----------+
+// |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+// +----+-----+-------+------+----------+----------+
+// | 1  |  1  | X'00' |  1   | Variable |    2     |
+// +----+-----+-------+------+----------+----------+
+type Reply struct {
+	Rep  byte // 0x00 表示成功，其余值参见 consts.Rep*
+	Addr Addr // BND.ADDR、BND.PORT
+}
+
+func (m *Reply) MarshalBinary() ([]byte, error) {
+	return m.Addr.appendBinary([]byte{consts.Version, m.Rep, consts.RSV})
+}
+
+func (m *Reply) ReadFrom(r io.Reader) (int64, error) {
+	n, rep, err := readHeader(r, "VER, REP, RSV")
+	if err != nil {
+		return n, err
+	}
+
+	an, err := m.Addr.readFrom(r)
+	n += an
+	if err != nil {
+		return n, err
+	}
+
+	m.Rep = rep
+	return n, nil
+}
+
+func (m *Reply) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// UDPHeader UDP ASSOCIATE 中每个数据报的头部（RFC 1928，7. Procedure for UDP-based clients）：
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+//
+// ReadFrom 只读取头部，数据报中剩余的部分为 DATA
+type UDPHeader struct {
+	Frag byte // 当前分片序号，0x00 表示这是一个独立的数据报
+	Addr Addr // DST.ADDR、DST.PORT
+}
+
+func (m *UDPHeader) MarshalBinary() ([]byte, error) {
+	return m.Addr.appendBinary([]byte{consts.RSV, consts.RSV, m.Frag})
+}
+
+func (m *UDPHeader) ReadFrom(r io.Reader) (int64, error) {
+	bp := pool.ByteSlice255.Get().(*[]byte)
+	defer pool.ByteSlice255.Put(bp)
+	b := *bp
+
+	n, err := io.ReadFull(r, b[:3])
+	if err != nil {
+		return int64(n), fmt.Errorf("read udp header[RSV, FRAG] error: %w", err)
+	}
+	if b[0] != consts.RSV || b[1] != consts.RSV {
+		return int64(n), ErrInvalidRSV
+	}
+	frag := b[2]
+
+	an, err := m.Addr.readFrom(r)
+	if err != nil {
+		return int64(n) + an, err
+	}
+
+	m.Frag = frag
+	return int64(n) + an, nil
+}
+
+func (m *UDPHeader) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// readHeader 读取请求和回复共有的前三个字节，返回第二个字节（CMD 或 REP）
+func readHeader(r io.Reader, fields string) (int64, byte, error) {
+	bp := pool.ByteSlice255.Get().(*[]byte)
+	defer pool.ByteSlice255.Put(bp)
+	b := *bp
+
+	n, err := io.ReadFull(r, b[:3])
+	if err != nil {
+		return int64(n), 0, fmt.Errorf("read header[%s] error: %w", fields, err)
+	}
+	if b[0] != consts.Version {
+		return int64(n), 0, ErrInvalidVersion
+	}
+	if b[2] != consts.RSV {
+		return int64(n), 0, ErrInvalidRSV
+	}
+	return int64(n), b[1], nil
+}
+
+func writeTo(w io.Writer, m encoding.BinaryMarshaler) (int64, error) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
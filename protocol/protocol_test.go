@@ -0,0 +1,223 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"zz.io/cargo/so5/consts"
+)
+
+type message interface {
+	encoding.BinaryMarshaler
+	io.ReaderFrom
+	io.WriterTo
+}
+
+var (
+	addrIPv4   = Addr{Type: consts.AtypIPv4, Host: "127.0.0.1", Port: 1080}
+	addrDomain = Addr{Type: consts.AtypDomain, Host: "example.com", Port: 443}
+	addrIPv6   = Addr{Type: consts.AtypIpv6, Host: "2001:db8::1", Port: 80}
+)
+
+// roundTripCases 每个报文及其编码结果
+var roundTripCases = []struct {
+	name string
+	msg  message
+	want []byte
+}{
+	{"MethodRequest", &MethodRequest{Methods: []byte{0x00, 0x02}}, []byte{5, 2, 0, 2}},
+	{"MethodSelection", &MethodSelection{Method: 0xff}, []byte{5, 0xff}},
+	{"UserPassRequest", &UserPassRequest{Version: 1, Username: "root", Password: "pw"},
+		[]byte{1, 4, 'r', 'o', 'o', 't', 2, 'p', 'w'}},
+	{"UserPassStatus", &UserPassStatus{Version: 1, Status: 0}, []byte{1, 0}},
+	{"RequestIPv4", &Request{Cmd: consts.CmdConnect, Addr: addrIPv4}, []byte{5, 1, 0, 1, 127, 0, 0, 1, 0x04, 0x38}},
+	{"RequestDomain", &Request{Cmd: consts.CmdBind, Addr: addrDomain},
+		append(append([]byte{5, 2, 0, 3, 11}, "example.com"...), 0x01, 0xbb)},
+	{"RequestIPv6", &Request{Cmd: consts.CmdUdp, Addr: addrIPv6},
+		append(append([]byte{5, 3, 0, 4}, net.ParseIP("2001:db8::1")...), 0x00, 0x50)},
+	{"Reply", &Reply{Rep: consts.RepConnectionRefused, Addr: addrIPv4}, []byte{5, 5, 0, 1, 127, 0, 0, 1, 0x04, 0x38}},
+	{"UDPHeader", &UDPHeader{Frag: 0, Addr: addrDomain},
+		append(append([]byte{0, 0, 0, 3, 11}, "example.com"...), 0x01, 0xbb)},
+	{"Socks4Request", &Socks4Request{Cmd: consts.CmdConnect, Port: 80, IP: [4]byte{10, 0, 0, 1}, UserID: "bob"},
+		[]byte{4, 1, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b', 0}},
+	{"Socks4aRequest", &Socks4Request{Cmd: consts.CmdBind, Port: 80, IP: [4]byte{0, 0, 0, 1}, Domain: "a.io"},
+		[]byte{4, 2, 0, 80, 0, 0, 0, 1, 0, 'a', '.', 'i', 'o', 0}},
+	{"Socks4Reply", &Socks4Reply{Rep: consts.Socks4RepGranted, Port: 1080, IP: [4]byte{127, 0, 0, 1}},
+		[]byte{0, 0x5a, 0x04, 0x38, 127, 0, 0, 1}},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range roundTripCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tc.want) {
+				t.Fatalf("MarshalBinary() = %v, want %v", b, tc.want)
+			}
+
+			var w bytes.Buffer
+			if n, err := tc.msg.WriteTo(&w); err != nil || n != int64(len(tc.want)) || !bytes.Equal(w.Bytes(), tc.want) {
+				t.Fatalf("WriteTo() = %v, %d, %v, want %v", w.Bytes(), n, err, tc.want)
+			}
+
+			// 后面多出来的数据不应当被读取
+			r := bytes.NewReader(append(append([]byte(nil), tc.want...), 0xee))
+			got := reflect.New(reflect.TypeOf(tc.msg).Elem()).Interface().(message)
+			n, err := got.ReadFrom(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(tc.want)) || r.Len() != 1 {
+				t.Fatalf("ReadFrom() read %d bytes, %d left, want %d, 1", n, r.Len(), len(tc.want))
+			}
+			if !reflect.DeepEqual(got, tc.msg) {
+				t.Fatalf("ReadFrom() = %+v, want %+v", got, tc.msg)
+			}
+		})
+	}
+}
+
+func TestReadFromInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+		in   []byte
+		want error
+	}{
+		{"MethodRequestVersion", &MethodRequest{}, []byte{4, 1, 0}, ErrInvalidVersion},
+		{"MethodRequestShort", &MethodRequest{}, []byte{5, 2, 0}, io.ErrUnexpectedEOF},
+		{"RequestRSV", &Request{}, []byte{5, 1, 1, 1, 127, 0, 0, 1, 0, 80}, ErrInvalidRSV},
+		{"RequestAtyp", &Request{}, []byte{5, 1, 0, 9, 127, 0, 0, 1, 0, 80}, ErrAtypNotSupported},
+		{"RequestShortDomain", &Request{}, []byte{5, 1, 0, 3, 5, 'a'}, io.ErrUnexpectedEOF},
+		{"ReplyEmpty", &Reply{}, nil, io.EOF},
+		{"UDPHeaderRSV", &UDPHeader{}, []byte{0, 1, 0, 1, 127, 0, 0, 1, 0, 80}, ErrInvalidRSV},
+		{"Socks4Version", &Socks4Request{}, []byte{5, 1, 0, 80, 10, 0, 0, 1, 0}, ErrInvalidVersion},
+		{"Socks4MissingUserID", &Socks4Request{}, []byte{4, 1, 0, 80, 10, 0, 0, 1}, io.EOF},
+		{"Socks4UserIDUnterminated", &Socks4Request{}, append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, bytes.Repeat([]byte{'u'}, 300)...), ErrInvalidSocks4String},
+		{"Socks4aEmptyDomain", &Socks4Request{}, []byte{4, 1, 0, 80, 0, 0, 0, 1, 0, 0}, ErrInvalidSocks4String},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.msg.ReadFrom(bytes.NewReader(tt.in)); !errors.Is(err, tt.want) {
+				t.Fatalf("ReadFrom() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+	}{
+		{"TooManyMethods", &MethodRequest{Methods: make([]byte, 256)}},
+		{"UsernameTooLong", &UserPassRequest{Username: string(make([]byte, 256))}},
+		{"DomainTooLong", &Request{Addr: Addr{Type: consts.AtypDomain, Host: string(make([]byte, 256))}}},
+		{"IPv6AsIPv4", &Reply{Addr: Addr{Type: consts.AtypIPv4, Host: "::1"}}},
+		{"Atyp", &UDPHeader{Addr: Addr{Type: 0x09, Host: "127.0.0.1"}}},
+		{"Socks4UserIDNUL", &Socks4Request{UserID: "a\x00b"}},
+		{"Socks4aNoDomain", &Socks4Request{IP: [4]byte{0, 0, 0, 1}}},
+		{"Socks4DomainWithoutIP", &Socks4Request{IP: [4]byte{10, 0, 0, 1}, Domain: "a.io"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.msg.MarshalBinary(); err == nil {
+				t.Fatal("MarshalBinary() error = nil")
+			}
+		})
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Addr
+	}{
+		{"127.0.0.1:1080", addrIPv4},
+		{"example.com:443", addrDomain},
+		{"[2001:db8::1]:80", addrIPv6},
+		{"[::ffff:127.0.0.1]:1080", addrIPv4},
+		{"[fe80::1%eth0]:22", Addr{Type: consts.AtypIpv6, Host: "fe80::1", Port: 22}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAddr(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseAddr(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"127.0.0.1", "127.0.0.1:65536", "127.0.0.1:-1", "[::1:80"} {
+		if _, err := ParseAddr(in); err == nil {
+			t.Errorf("ParseAddr(%q) error = nil", in)
+		}
+	}
+}
+
+// fuzzRoundTrip 任何能被 ReadFrom 接受的输入，重新编码后都应当与读取的字节完全相同
+func fuzzRoundTrip(f *testing.F, newMsg func() message) {
+	for _, tc := range roundTripCases {
+		f.Add(tc.want)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := newMsg()
+		n, err := msg.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		b, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() of %+v error = %v", msg, err)
+		}
+		if !bytes.Equal(b, data[:n]) {
+			t.Fatalf("re-encoded %v, read %v", b, data[:n])
+		}
+	})
+}
+
+func FuzzMethodRequest(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &MethodRequest{} })
+}
+
+func FuzzMethodSelection(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &MethodSelection{} })
+}
+
+func FuzzUserPassRequest(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &UserPassRequest{} })
+}
+
+func FuzzUserPassStatus(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &UserPassStatus{} })
+}
+
+func FuzzRequest(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &Request{} })
+}
+
+func FuzzReply(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &Reply{} })
+}
+
+func FuzzUDPHeader(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &UDPHeader{} })
+}
+
+func FuzzSocks4Request(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &Socks4Request{} })
+}
+
+func FuzzSocks4Reply(f *testing.F) {
+	fuzzRoundTrip(f, func() message { return &Socks4Reply{} })
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/util/pool"
+)
+
+// ErrInvalidSocks4String USERID 或 4a 的域名过长、为空或包含 NUL
+var ErrInvalidSocks4String = errors.New("invalid socks4 USERID or domain")
+
+// maxSocks4String USERID 和域名的最大长度（不包括结尾的 NUL），协议本身没有限制，
+// 这里限制长度以免恶意客户端无限地发送数据
+const maxSocks4String = 254
+
+// Socks4Request SOCKS4 的请求，DSTIP 为 0.0.0.x（x 不为 0）时为 SOCKS4a，USERID 之后跟着以 NUL 结尾的域名：
+// +----+----+---------+--------+------------+------+------------------+------+
+// | VN | CD | DSTPORT | DSTIP  |   USERID   | NULL |  DOMAIN（仅 4a） | NULL |
+// +----+----+---------+--------+------------+------+------------------+------+
+// | 1  | 1  |    2    |   4    |  Variable  |  1   |     Variable     |  1   |
+// +----+----+---------+--------+------------+------+------------------+------+
+//
+// VN	0x04
+// CD	0x01=CONNECT, 0x02=BIND
+type Socks4Request struct {
+	Cmd    byte
+	Port   uint16
+	IP     [4]byte
+	UserID string
+	Domain string // 仅 SOCKS4a
+}
+
+// Is4a DSTIP 是否为 SOCKS4a 约定的 0.0.0.x（x 不为 0）
+func (m *Socks4Request) Is4a() bool {
+	return m.IP[0] == 0 && m.IP[1] == 0 && m.IP[2] == 0 && m.IP[3] != 0
+}
+
+// Host 目标地址，SOCKS4a 时为域名
+func (m *Socks4Request) Host() string {
+	if m.Is4a() {
+		return m.Domain
+	}
+	return netip.AddrFrom4(m.IP).String()
+}
+
+func (m *Socks4Request) MarshalBinary() ([]byte, error) {
+	if !validSocks4String(m.UserID) {
+		return nil, ErrInvalidSocks4String
+	}
+	if m.Is4a() != (m.Domain != "") || !validSocks4String(m.Domain) {
+		return nil, ErrInvalidSocks4String
+	}
+
+	b := []byte{consts.Socks4Version, m.Cmd}
+	b = binary.BigEndian.AppendUint16(b, m.Port)
+	b = append(b, m.IP[:]...)
+	b = append(b, m.UserID...)
+	b = append(b, 0)
+	if m.Is4a() {
+		b = append(b, m.Domain...)
+		b = append(b, 0)
+	}
+	return b, nil
+}
+
+func (m *Socks4Request) ReadFrom(r io.Reader) (int64, error) {
+	bp := pool.ByteSlice255.Get().(*[]byte)
+	defer pool.ByteSlice255.Put(bp)
+	b := *bp
+
+	n, err := io.ReadFull(r, b[:8])
+	if err != nil {
+		return int64(n), fmt.Errorf("read socks4 header[VN, CD, DSTPORT, DSTIP] error: %w", err)
+	}
+	if b[0] != consts.Socks4Version {
+		return int64(n), ErrInvalidVersion
+	}
+
+	req := Socks4Request{Cmd: b[1], Port: binary.BigEndian.Uint16(b[2:4]), IP: [4]byte(b[4:8])}
+
+	sn, err := readSocks4String(r, b)
+	n += sn
+	if err != nil {
+		return int64(n), fmt.Errorf("read socks4 USERID error: %w", err)
+	}
+	req.UserID = string(b[:sn-1])
+
+	if req.Is4a() {
+		dn, err := readSocks4String(r, b)
+		n += dn
+		if err != nil {
+			return int64(n), fmt.Errorf("read socks4a domain error: %w", err)
+		}
+		if dn == 1 {
+			return int64(n), ErrInvalidSocks4String
+		}
+		req.Domain = string(b[:dn-1])
+	}
+
+	*m = req
+	return int64(n), nil
+}
+
+func (m *Socks4Request) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// Socks4Reply SOCKS4 的回复，BIND 时 DSTPORT、DSTIP 为监听的地址或连入的地址，其他情况忽略：
+// +----+----+---------+--------+
+// | VN | CD | DSTPORT | DSTIP  |
+// +----+----+---------+--------+
+// | 1  | 1  |    2    |   4    |
+// +----+----+---------+--------+
+//
+// VN	0x00
+// CD	0x5a=成功，0x5b=失败，参见 consts.Socks4Rep*
+type Socks4Reply struct {
+	Rep  byte
+	Port uint16
+	IP   [4]byte
+}
+
+func (m *Socks4Reply) MarshalBinary() ([]byte, error) {
+	b := []byte{consts.Socks4ReplyVersion, m.Rep}
+	b = binary.BigEndian.AppendUint16(b, m.Port)
+	return append(b, m.IP[:]...), nil
+}
+
+func (m *Socks4Reply) ReadFrom(r io.Reader) (int64, error) {
+	bp := pool.ByteSlice255.Get().(*[]byte)
+	defer pool.ByteSlice255.Put(bp)
+	b := *bp
+
+	n, err := io.ReadFull(r, b[:8])
+	if err != nil {
+		return int64(n), fmt.Errorf("read socks4 reply error: %w", err)
+	}
+	if b[0] != consts.Socks4ReplyVersion {
+		return int64(n), ErrInvalidVersion
+	}
+
+	*m = Socks4Reply{Rep: b[1], Port: binary.BigEndian.Uint16(b[2:4]), IP: [4]byte(b[4:8])}
+	return int64(n), nil
+}
+
+func (m *Socks4Reply) WriteTo(w io.Writer) (int64, error) { return writeTo(w, m) }
+
+// readSocks4String 逐字节读取以 NUL 结尾的字符串到 b 中，返回读取的字节数（包括 NUL），
+// 不会多读属于后续数据的字节；b 的长度至少为 maxSocks4String+1
+func readSocks4String(r io.Reader, b []byte) (int, error) {
+	for n := 0; ; n++ {
+		if n > maxSocks4String {
+			return n, ErrInvalidSocks4String
+		}
+		if _, err := io.ReadFull(r, b[n:n+1]); err != nil {
+			return n, err
+		}
+		if b[n] == 0 {
+			return n + 1, nil
+		}
+	}
+}
+
+func validSocks4String(s string) bool {
+	return len(s) <= maxSocks4String && strings.IndexByte(s, 0) < 0
+}
@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout 转发的两个方向在 timeout 内都没有数据
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// IdleTracker 记录一次转发（两个方向）最近一次收到数据的时间，用于实现空闲超时。
+//
+// 每个方向各自设置读超时，某个方向超时的时候如果另一个方向仍然活跃则继续等待，
+// 这样单向的长时间下载（客户端一直不发送数据）不会被误判为空闲；
+// 只有两个方向都超过 timeout 没有数据时，才返回 ErrIdleTimeout。
+// 某个方向结束（半关闭）后，剩下的方向仍然从最近一次收到数据的时间开始计算，
+// 不会重新获得一个完整的 timeout。
+type IdleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano
+
+	// suspect 使用 splice 时某个方向已经超时，等待另一个方向确认，参见 splice
+	suspect atomic.Bool
+	// halfClosed 某个方向已经结束，剩下的方向超时时不需要等待确认
+	halfClosed atomic.Bool
+}
+
+// NewIdleTracker timeout 为 0 时不限制
+func NewIdleTracker(timeout time.Duration) *IdleTracker {
+	t := &IdleTracker{timeout: timeout}
+	t.touch()
+	return t
+}
+
+// Reader 返回从 conn 读取数据的 io.Reader，读取时会设置 conn 的读超时
+func (t *IdleTracker) Reader(conn net.Conn) io.Reader {
+	if t.timeout <= 0 {
+		return conn
+	}
+	return &idleReader{conn: conn, tracker: t}
+}
+
+func (t *IdleTracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+	if t.suspect.Load() {
+		t.suspect.Store(false)
+	}
+}
+
+// closeHalf 标记某个方向已经结束
+func (t *IdleTracker) closeHalf() {
+	t.halfClosed.Store(true)
+}
+
+// idleFor 距离最近一次收到数据的时间
+func (t *IdleTracker) idleFor() time.Duration {
+	return time.Since(time.Unix(0, t.last.Load()))
+}
+
+type idleReader struct {
+	conn    net.Conn
+	tracker *IdleTracker
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		// 超时时间从两个方向中最近一次收到数据的时间开始计算
+		deadline := time.Now().Add(r.tracker.timeout - r.tracker.idleFor())
+		if err := r.conn.SetReadDeadline(deadline); err != nil {
+			// 例如 net.Pipe 的对端关闭后设置超时会失败，此时直接读取，由 Read 返回 EOF 等实际的状态
+			return r.conn.Read(p)
+		}
+
+		n, err := r.conn.Read(p)
+		if n > 0 {
+			r.tracker.touch()
+		}
+		if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			if r.tracker.idleFor() < r.tracker.timeout {
+				// 另一个方向仍然活跃，继续等待
+				if n > 0 {
+					return n, nil
+				}
+				continue
+			}
+			return n, ErrIdleTimeout
+		}
+		return n, err
+	}
+}
+
+// splice 使用 dst.ReadFrom(src) 复制数据（Linux 上为 splice(2)），同时检测空闲。
+//
+// ReadFrom 只在 src 读到 EOF、出错或读超时时返回，复制过程中无法更新最近收到数据的时间，
+// 所以某个方向读超时的时候，另一个方向可能正在复制数据而还没有报告。
+// 这时先把 suspect 标记为 true，再把 dst（也就是另一个方向的 src）的读超时设为当前时间，
+// 使另一个方向的 ReadFrom 返回：期间有数据则更新时间并清除标记，继续转发；
+// 没有数据时它发现标记已经被设置，确认两个方向都已空闲，返回 ErrIdleTimeout。
+// 另一个方向已经结束时没有人可以确认，直接返回 ErrIdleTimeout
+func (t *IdleTracker) splice(dst, src *net.TCPConn) (int64, error) {
+	var written int64
+	poked := false
+	for {
+		deadline := time.Now().Add(t.timeout - t.idleFor())
+		if poked {
+			// 等待另一个方向确认，它一直没有返回时（例如阻塞在写入）本方向在 timeout 后自行结束
+			deadline, poked = time.Now().Add(t.timeout), false
+		}
+		if err := src.SetReadDeadline(deadline); err != nil {
+			return written, err
+		}
+
+		n, err := dst.ReadFrom(src)
+		written += n
+		if n > 0 {
+			t.touch()
+		}
+		if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return written, err
+		}
+		if t.idleFor() < t.timeout {
+			continue
+		}
+		if t.halfClosed.Load() || !t.suspect.CompareAndSwap(false, true) {
+			return written, ErrIdleTimeout
+		}
+		_ = dst.SetReadDeadline(time.Now())
+		poked = true
+	}
+}
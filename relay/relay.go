@@ -0,0 +1,112 @@
+// Package relay 在两个连接之间双向转发数据，服务端与客户端共用。
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zz.io/cargo/so5/util/pool"
+)
+
+// Stats 一次转发中每个方向传输的字节数
+type Stats struct {
+	AToB int64 // 从 a 读取并写入 b 的字节数
+	BToA int64 // 从 b 读取并写入 a 的字节数
+}
+
+// closeWriter 支持半关闭的连接，例如 *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Relay 在 a 和 b 之间双向转发数据，直到两个方向都结束才返回。
+//
+//   - 某个方向读到 EOF 时，对另一端调用 CloseWrite 把 FIN 传递过去，另一个方向继续转发，
+//     这样依赖 TCP 半关闭的协议（例如 nc -N、HTTP/1.0 上传）可以正常工作；
+//     不支持半关闭（没有 CloseWrite 或 CloseWrite 失败）的连接会被直接关闭，
+//     此后另一个方向因该连接被关闭而产生的错误视为正常结束
+//   - 两端都是 TCP 时，Linux 上使用 splice(2) 在内核中直接搬运数据，
+//     其余情况使用 pool.ByteSlice32K 中的缓冲区
+//   - 某个方向出错或空闲超时（idleTimeout 为 0 时不限制）时，关闭 a 和 b 使另一个方向也结束，
+//     返回第一个错误，另一个方向因连接被关闭而产生的错误会被忽略
+//
+// Relay 返回后由调用方负责关闭 a 和 b
+func Relay(a, b net.Conn, idleTimeout time.Duration) (Stats, error) {
+	var (
+		stats    Stats
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+
+		// closedOnEOF 某个方向正常结束后，因为不支持半关闭而直接关闭了另一端
+		closedOnEOF atomic.Bool
+	)
+
+	abort := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			a.Close()
+			b.Close()
+		})
+	}
+
+	idle := NewIdleTracker(idleTimeout)
+	copyHalf := func(dst, src net.Conn, n *int64) {
+		defer wg.Done()
+
+		written, err := copyConn(dst, src, idle)
+		*n = written
+		if err != nil {
+			if closedOnEOF.Load() && isClosedErr(err) {
+				return
+			}
+			abort(err)
+			return
+		}
+
+		// src 不会再有数据，通知 dst
+		idle.closeHalf()
+		if cw, ok := dst.(closeWriter); !ok || cw.CloseWrite() != nil {
+			closedOnEOF.Store(true)
+			dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go copyHalf(b, a, &stats.AToB)
+	go copyHalf(a, b, &stats.BToA)
+	wg.Wait()
+
+	return stats, firstErr
+}
+
+// isClosedErr 判断 err 是否因为读写已经关闭的连接而产生
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// copyConn 将 src 的数据复制到 dst，直到 src 读到 EOF 或出错
+func copyConn(dst, src net.Conn, idle *IdleTracker) (int64, error) {
+	// TCPConn.ReadFrom 在 Linux 上会使用 splice(2)，其他平台退化为普通的复制
+	if d, ok := dst.(*net.TCPConn); ok {
+		if s, ok := src.(*net.TCPConn); ok {
+			if idle.timeout <= 0 {
+				return d.ReadFrom(s)
+			}
+			return idle.splice(d, s)
+		}
+	}
+
+	bp := pool.ByteSlice32K.Get().(*[]byte)
+	defer pool.ByteSlice32K.Put(bp)
+	// 隐藏 dst 的 ReadFrom 和 src 的 WriteTo，保证 io.CopyBuffer 使用池中的缓冲区而不是自行分配
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{idle.Reader(src)}, *bp)
+}
+
+type readerOnly struct{ io.Reader }
+
+type writerOnly struct{ io.Writer }
@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const benchChunk = 32 * 1024
+
+// tcpPair 返回一对相连的 TCP 连接
+func tcpPair(b testing.TB) (*net.TCPConn, *net.TCPConn) {
+	b.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer lis.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := lis.Accept()
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		b.Fatal("accept failed")
+	}
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+// benchmarkRelay 测量 src -> a =relay=> b -> dst 方向的吞吐，relayFn 负责在 a 和 b 之间转发
+func benchmarkRelay(b *testing.B, relayFn func(a, b net.Conn)) {
+	src, a := tcpPair(b)
+	bb, dst := tcpPair(b)
+	defer src.Close()
+	defer dst.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relayFn(a, bb)
+		a.Close()
+		bb.Close()
+	}()
+
+	chunk := make([]byte, benchChunk)
+	b.SetBytes(benchChunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := src.Write(chunk); err != nil {
+				return
+			}
+		}
+		src.CloseWrite()
+	}()
+
+	n, err := io.Copy(io.Discard, dst)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	if n != int64(b.N)*benchChunk {
+		b.Fatalf("received %d bytes, want %d", n, int64(b.N)*benchChunk)
+	}
+
+	dst.CloseWrite()
+	<-done
+}
+
+// BenchmarkRelay 两端都是 TCP，无论是否限制空闲时间都走 splice
+func BenchmarkRelay(b *testing.B) {
+	b.Run("NoIdleTimeout", func(b *testing.B) {
+		benchmarkRelay(b, func(a, c net.Conn) { Relay(a, c, 0) })
+	})
+	b.Run("IdleTimeout", func(b *testing.B) {
+		benchmarkRelay(b, func(a, c net.Conn) { Relay(a, c, time.Minute) })
+	})
+}
+
+// BenchmarkIOCopy 作为对比：每个方向直接使用 io.Copy 并包装空闲超时
+func BenchmarkIOCopy(b *testing.B) {
+	benchmarkRelay(b, func(a, c net.Conn) {
+		idle := NewIdleTracker(time.Minute)
+		up := make(chan struct{})
+		go func() {
+			io.Copy(c, idle.Reader(a))
+			c.(*net.TCPConn).CloseWrite()
+			close(up)
+		}()
+		io.Copy(a, idle.Reader(c))
+		<-up
+	})
+}
+
+// BenchmarkRelaySession 每次建立一个新的转发并交换少量数据，体现每个会话的内存开销，
+// net.Pipe 不支持 splice，两个方向都需要缓冲区
+func BenchmarkRelaySession(b *testing.B) {
+	msg := make([]byte, 1024)
+	buf := make([]byte, len(msg))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		src, a := net.Pipe()
+		c, dst := net.Pipe()
+
+		done := make(chan struct{})
+		go func() {
+			Relay(a, c, 0)
+			close(done)
+		}()
+
+		go func() {
+			src.Write(msg)
+			io.ReadFull(dst, buf)
+			dst.Write(buf)
+		}()
+		if _, err := io.ReadFull(src, buf); err != nil {
+			b.Fatal(err)
+		}
+
+		src.Close()
+		dst.Close()
+		<-done
+	}
+}
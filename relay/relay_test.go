@@ -0,0 +1,150 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRelayPipe net.Pipe 不支持半关闭，一端关闭后转发正常结束，不返回因连接被关闭而产生的错误
+func TestRelayPipe(t *testing.T) {
+	for _, idleTimeout := range []time.Duration{0, time.Minute} {
+		t.Run(idleTimeout.String(), func(t *testing.T) {
+			client, a := net.Pipe()
+			b, target := net.Pipe()
+			defer client.Close()
+			defer target.Close()
+
+			type result struct {
+				stats Stats
+				err   error
+			}
+			done := make(chan result, 1)
+			go func() {
+				stats, err := Relay(a, b, idleTimeout)
+				a.Close()
+				b.Close()
+				done <- result{stats, err}
+			}()
+
+			received := make(chan string, 1)
+			go func() {
+				io.WriteString(target, "pong")
+				got, _ := io.ReadAll(target)
+				received <- string(got)
+			}()
+
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+				t.Fatalf("client read %q, %v, want pong", buf, err)
+			}
+			if _, err := io.WriteString(client, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			client.Close()
+
+			if got := <-received; got != "ping" {
+				t.Fatalf("target received %q, want ping", got)
+			}
+			select {
+			case r := <-done:
+				if r.err != nil {
+					t.Fatalf("Relay error = %v, want nil", r.err)
+				}
+				if r.stats != (Stats{AToB: 4, BToA: 4}) {
+					t.Fatalf("Relay stats = %+v, want 4 bytes each way", r.stats)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("Relay did not return after client closed")
+			}
+		})
+	}
+}
+
+// TestRelaySpliceIdle 两端都是 TCP 时使用 splice，只有一个方向有数据时不超时，两个方向都没有数据后超时
+func TestRelaySpliceIdle(t *testing.T) {
+	const idleTimeout = 300 * time.Millisecond
+	client, a := tcpPair(t)
+	b, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Relay(a, b, idleTimeout)
+		a.Close()
+		b.Close()
+		done <- err
+	}()
+	go io.Copy(io.Discard, target)
+
+	// 单向的数据间隔小于超时时间，持续超过超时时间
+	for i := 0; i < 8; i++ {
+		if _, err := client.Write([]byte("x")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		time.Sleep(idleTimeout / 3)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Relay returned %v while data was flowing", err)
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("Relay error = %v, want %v", err, ErrIdleTimeout)
+		}
+		if elapsed := time.Since(start); elapsed > 2*idleTimeout {
+			t.Fatalf("Relay returned %v after the last data, want about %v", elapsed, idleTimeout)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Relay did not time out")
+	}
+}
+
+// TestRelayHalfCloseIdle 一个方向结束后，剩下的方向仍然从最近一次收到数据的时间开始计算空闲超时
+func TestRelayHalfCloseIdle(t *testing.T) {
+	const idleTimeout = 300 * time.Millisecond
+	client, a := tcpPair(t)
+	b, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Relay(a, b, idleTimeout)
+		a.Close()
+		b.Close()
+		done <- err
+	}()
+
+	// 让 b 到 a 的方向先等待一段时间，再结束 a 到 b 的方向
+	time.Sleep(idleTimeout / 2)
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(target); err != nil || string(got) != "x" {
+		t.Fatalf("target read %q, %v, want x", got, err)
+	}
+	start := time.Now()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("Relay error = %v, want %v", err, ErrIdleTimeout)
+		}
+		if elapsed := time.Since(start); elapsed > idleTimeout*3/2 {
+			t.Fatalf("Relay returned %v after the half close, want about %v", elapsed, idleTimeout)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Relay did not time out")
+	}
+}
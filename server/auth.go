@@ -1,18 +1,23 @@
 package server
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 
 	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/util/pool"
 )
 
-const (
-	Username = "root"
-	Password = "root"
+var (
+	// ErrNoAcceptableMethod 客户端提供的认证方式中没有服务端可接受的
+	ErrNoAcceptableMethod = errors.New("no acceptable auth method")
+	// ErrAuthFailed 用户名/密码校验失败
+	ErrAuthFailed = errors.New("username/password auth failed")
 )
 
 // RFC 1928, https://www.ietf.org/rfc/rfc1928.txt
@@ -35,98 +40,126 @@ const (
 // 0x03 至 X’7F’ IANA 分配(IANA ASSIGNED)
 // 0x80 至 X’FE’ 私人方法保留(RESERVED FOR PRIVATE METHODS)
 // 0xFF 无可接受方法(NO ACCEPTABLE METHODS)
-// method 由服务提供者自行定义
-func NegotiationAuth(conn net.Conn, method byte) error {
-	buf := make([]byte, 255)
+// auths 由服务提供者自行定义，为服务端可接受的认证方式，按优先级从高到低排列，服务端会从中选出第一个
+// 客户端也支持的方式；auths 为空时默认使用 NoAuth。
+//
+// 需要知道选定的方式和客户身份时使用 Negotiate。
+func NegotiationAuth(conn net.Conn, auths ...Authenticator) error {
+	_, err := Negotiate(conn, auths...)
+	return err
+}
 
-	// 使用 ReadFull 保证读满 2 字节的数据，否则返回错误
-	_, err := io.ReadFull(conn, buf[:2])
-	if err != nil {
-		return errors.New("read header[ver, nmethods] error: " + err.Error())
+// AuthInfo 方法协商和认证的结果
+type AuthInfo struct {
+	Method   byte   // 选定的认证方式
+	Identity string // Authenticator 返回的客户身份，NoAuth 时为空
+}
+
+// Negotiate 与 NegotiationAuth 相同，成功时返回选定的认证方式和客户身份。
+// 没有可接受的方式时回复 METHOD 0xFF 并返回 ErrNoAcceptableMethod，调用方随后应当关闭连接
+func Negotiate(conn net.Conn, auths ...Authenticator) (AuthInfo, error) {
+	if len(auths) == 0 {
+		auths = []Authenticator{NoAuth{}}
 	}
 
-	ver := buf[0]
-	nmethods := buf[1]
-	log.Printf("ver: %v, nmethods: %v\n", ver, nmethods)
+	bp := pool.ByteSlice255.Get().(*[]byte)
+	defer pool.ByteSlice255.Put(bp)
 
-	// socket 版本必须为 5
-	if ver != consts.Version {
-		errMsg := "invalid version"
-		log.Println(errMsg)
-		return errors.New(errMsg)
+	// 客户端支持的认证方式读到池中的缓冲区里，避免每个连接分配一次
+	greeting := protocol.MethodRequest{Methods: (*bp)[:0]}
+	if _, err := greeting.ReadFrom(conn); err != nil {
+		return AuthInfo{}, err
 	}
 
-	// 将用户支持的验证方法全部读出来
-	_, err = io.ReadFull(conn, buf[:nmethods])
-	if err != nil {
-		errMsg := "read methods error: " + err.Error()
-		log.Println(errMsg)
-		return errors.New(errMsg)
+	// 按服务端的优先级选出第一个客户端也支持的方法
+	var auth Authenticator
+	for _, a := range auths {
+		if bytes.IndexByte(greeting.Methods, a.Method()) >= 0 {
+			auth = a
+			break
+		}
 	}
 
-	// 将用户支持的验证方法保存到 map 中，主要用于服务端回复检测
-	clientSupportAutoMethod := make(map[byte]struct{})
-	for i := 0; i < int(nmethods); i++ {
-		clientSupportAutoMethod[buf[i]] = struct{}{}
+	if auth == nil {
+		// 服务端提供的验证方法不被客户端接受，客户端收到该报文后应当断开连接
+		sel := protocol.MethodSelection{Method: consts.AuthTypeNoAcceptable}
+		if _, err := sel.WriteTo(conn); err != nil {
+			return AuthInfo{}, err
+		}
+		return AuthInfo{}, ErrNoAcceptableMethod
 	}
 
-	// 服务端提供的验证方法不被客户端接受，客户端收到该报文后应当断开连接
-	if _, ok := clientSupportAutoMethod[method]; !ok {
-		_, err := conn.Write([]byte{consts.Version, consts.AuthTypeNoAcceptable})
-		if err != nil {
-			log.Println(err)
-			return err
-		}
+	// 服务端从客户支持的认证方式中选择一种发送给客户，
+	// 表示需要客户使用此方式进行验证，回复的报文格式为：
+	// +-----+--------+
+	// | VER | METHOD |
+	// +-----+--------+
+	// |  1  |   1    |
+	// +-----+--------+
+	//
+	// VER		本次请求的协议版本号，取固定值 0x05（表示 socks 5）
+	// METHOD	服务端选定的验证方式
+	sel := protocol.MethodSelection{Method: auth.Method()}
+	if _, err := sel.WriteTo(conn); err != nil {
+		return AuthInfo{}, fmt.Errorf("write selected method error: %w", err)
 	}
 
-	switch method {
-	case consts.AuthTypeNoRequired:
-		if err := NoAuthRequireHandler(conn); err != nil {
-			return err
-		}
-	case consts.AuthTypeUnamePwd:
-		if err := UnamePwdHandler(conn); err != nil {
-			return err
-		}
+	identity, err := auth.Authenticate(conn)
+	if err != nil {
+		return AuthInfo{}, err
 	}
 
-	return nil
+	return AuthInfo{Method: auth.Method(), Identity: identity}, nil
 }
 
-// 客户身份验证通过后，服务端会查看客户支持的认证方式，从中选择一种发送给客户，
-// 表示需要客户使用此方式进行验证，回复的报文格式为：
-// +-----+--------+
-// | VER | METHOD |
-// +-----+--------+
-// |  1  |   1    |
-// +-----+--------+
-//
-// VER		本次请求的协议版本号，取固定值 0x05（表示 socks 5）
-// METHOD	服务端选定的验证方式
-//
+// Authenticator 服务端支持的一种认证方式，使用者可以自行实现以接入自己的用户体系
+type Authenticator interface {
+	// Method 返回该认证方式对应的 METHOD
+	Method() byte
+	// Authenticate 在服务端把选定的 METHOD 回复给客户之后调用，负责完成该方式的子协商，
+	// 返回客户的身份（例如用户名），认证失败时返回错误，服务端随后会断开连接
+	Authenticate(conn net.Conn) (identity string, err error)
+}
 
-// NoAuthRequireHandler 回复客户端，连接不需要进行验证
-func NoAuthRequireHandler(conn net.Conn) error {
-	_, err := conn.Write([]byte{consts.Version, consts.AuthTypeNoRequired})
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	return nil
+// NoAuth 无需认证（METHOD 0x00）
+type NoAuth struct{}
+
+func (NoAuth) Method() byte { return consts.AuthTypeNoRequired }
+
+func (NoAuth) Authenticate(conn net.Conn) (string, error) { return "", nil }
+
+// CredentialStore 用户名/密码的存储，由使用者提供
+type CredentialStore interface {
+	// Valid 校验用户名和密码是否匹配
+	Valid(username, password string) bool
 }
 
-// UnamePwdHandler 回复客户端，连接需要通过 用户名/密码 方式进行验证
-func UnamePwdHandler(conn net.Conn) error {
-	_, err := conn.Write([]byte{consts.Version, consts.AuthTypeUnamePwd})
-	if err != nil {
-		log.Println("write support method to client error: ", err)
-		return err
+// StaticCredentials 保存在内存中的 用户名 -> 密码
+type StaticCredentials map[string]string
+
+func (s StaticCredentials) Valid(username, password string) bool {
+	pwd, ok := s[username]
+	if !ok {
+		return false
 	}
+	return subtle.ConstantTimeCompare([]byte(pwd), []byte(password)) == 1
+}
+
+// UserPassAuth 用户名/密码认证（METHOD 0x02，RFC 1929），用户信息由 Store 提供
+type UserPassAuth struct {
+	Store CredentialStore
+
+	// AcceptLegacyVersion 是否接受子协商版本号为 0x05 的请求。
+	// 旧版本的 so5 客户端错误地使用了 0x05，迁移期间可以打开，回复时使用与请求相同的版本号
+	AcceptLegacyVersion bool
+}
+
+func (UserPassAuth) Method() byte { return consts.AuthTypeUnamePwd }
 
-	uname, pwd, err := getUnamePwd(conn)
+func (a UserPassAuth) Authenticate(conn net.Conn) (string, error) {
+	ver, uname, pwd, err := getUnamePwd(conn, a.AcceptLegacyVersion)
 	if err != nil {
-		//log.Println("get username and password error: ", err)
-		return err
+		return "", err
 	}
 
 	// +----+--------+
@@ -136,22 +169,20 @@ func UnamePwdHandler(conn net.Conn) error {
 	// +----+--------+
 	// 服务端将验证结果发送给客户，如果验证成功则返回状态 0x00,否则返回任何非 0x00 的值。
 	// 客户端收到未成功验的状态必须关闭当前连接。
-	ok := authUser(uname, pwd)
-	if ok {
-		_, err = conn.Write([]byte{consts.Version, consts.AuthUserOk})
-		if err != nil {
-			log.Println("write auth result response error: ", err)
-			return err
+	// 认证结果不在这里记录日志，由服务端通过 Config.Logger 记录返回的身份或错误
+	if a.Store != nil && a.Store.Valid(uname, pwd) {
+		status := protocol.UserPassStatus{Version: ver, Status: consts.AuthUserOk}
+		if _, err := status.WriteTo(conn); err != nil {
+			return "", fmt.Errorf("write auth status error: %w", err)
 		}
-		return nil
+		return uname, nil
 	}
 
-	_, err = conn.Write([]byte{consts.Version, consts.AuthUserFail})
-	if err != nil {
-		log.Println("write auth result response error: ", err)
-		return err
+	status := protocol.UserPassStatus{Version: ver, Status: consts.AuthUserFail}
+	if _, err := status.WriteTo(conn); err != nil {
+		return "", fmt.Errorf("write auth status error: %w", err)
 	}
-	return nil
+	return "", fmt.Errorf("user %q: %w", uname, ErrAuthFailed)
 }
 
 // 如果客户选择了 用户名/密码 协议，那么客户将会发送如下报文：
@@ -163,67 +194,23 @@ func UnamePwdHandler(conn net.Conn) error {
 // | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
 // +----+------+----------+------+----------+
 //
-// VER 		协议版本号
+// VER 		子协商的版本号，固定为 0x01
 // ULEN 	用户名长度
 // UNAME 	用户名
 // PLEN 	密码长度
 // PASSWD 	密码
 //
-// getUnamePwd 从 conn 中读取客户发送的请求报文，并得到 username 和 password
-func getUnamePwd(conn net.Conn) (uname, pwd string, err error) {
-	buf := make([]byte, 255)
-
-	// 读取 VER 和 ULEN
-	_, err = io.ReadFull(conn, buf[:2])
-	if err != nil {
-		return "", "", err
-	}
-
-	ver := buf[0]
-	ulen := buf[1]
-
-	if ver != consts.Version {
-		errMsg := fmt.Errorf("invalid version")
-		log.Println(errMsg)
-		return "", "", errMsg
+// getUnamePwd 从 r 中读取客户发送的请求报文，并得到 username 和 password，
+// acceptLegacy 为 true 时同时接受旧版本 so5 客户端使用的版本号 0x05
+func getUnamePwd(r io.Reader, acceptLegacy bool) (ver byte, uname, pwd string, err error) {
+	var req protocol.UserPassRequest
+	if _, err = req.ReadFrom(r); err != nil {
+		return 0, "", "", err
 	}
 
-	// 读取 USERNAME
-	_, err = io.ReadFull(conn, buf[:ulen])
-	if err != nil {
-		errMsg := fmt.Errorf("read USERNAME error: %+v\n", err)
-		log.Println(errMsg)
-		return "", "", errMsg
-	}
-
-	uname = string(buf[:ulen])
-
-	// 读取 PLEN
-	_, err = io.ReadFull(conn, buf[:1])
-	if err != nil {
-		log.Printf("read PLEN error: %+v\n", err)
-		return "", "", fmt.Errorf("read PLEN error: %+v ", err)
+	if req.Version != consts.UserPassVersion && !(acceptLegacy && req.Version == consts.Version) {
+		return 0, "", "", fmt.Errorf("invalid username/password auth version %#x", req.Version)
 	}
-	plen := int(buf[0])
 
-	// 读取 PASSWORD
-	_, err = io.ReadFull(conn, buf[:plen])
-	if err != nil {
-		log.Printf("read PLEN error: %+v\n", err)
-		return "", "", fmt.Errorf("read PLEN error: %+v ", err)
-	}
-	pwd = string(buf[:plen])
-
-	return uname, pwd, nil
-}
-
-// authUser 对用户名和密码进行验证，TODO 使用者自行实现
-func authUser(uname, pwd string) bool {
-	b := uname == Username && pwd == Password
-	if b {
-		log.Printf("user %v auth success", uname)
-	} else {
-		log.Printf("user %v auth fail", uname)
-	}
-	return b
+	return req.Version, req.Username, req.Password, nil
 }
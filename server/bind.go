@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/relay"
+)
+
+// BindAcceptTimeout BIND 命令等待目标服务器连入的默认最长时间，可通过 Config.BindTimeout 修改
+const BindAcceptTimeout = 2 * time.Minute
+
+// handleBind 处理 BIND 命令（参见 RFC 1928，4. Requests 中 BIND 一节）
+//
+// BIND 用于需要目标服务器主动连接客户端的协议（例如 FTP 的主动模式），流程为：
+//  1. 服务端在与客户端连接相同的网卡上打开一个监听端口，
+//     通过第一个回复把监听的 BND.ADDR/BND.PORT 告诉客户端
+//  2. 客户端把该地址通过主连接告诉目标服务器，目标服务器连入
+//  3. 服务端校验连入的地址是否与请求中的 DST.ADDR 一致，
+//     然后通过第二个回复把对端的地址告诉客户端，之后开始转发数据
+//
+// req.DstAddr 为 0.0.0.0 或 :: 时不校验连入的地址
+func (s *Server) handleBind(conn net.Conn, req *Request) error {
+	lis, err := listenForBind(conn)
+	if err != nil {
+		_ = req.reply(conn, replyCode(err), nil)
+		return fmt.Errorf("bind listen error: %+v", err)
+	}
+	defer lis.Close()
+	// 服务端被强制关闭时中断等待
+	stopLis := context.AfterFunc(s.ctx, func() { lis.Close() })
+	defer stopLis()
+
+	// 第一次回复，告诉客户端服务端监听的地址
+	if err := req.reply(conn, consts.RepSuccess, lis.Addr()); err != nil {
+		return err
+	}
+
+	timeout := s.cfg.BindTimeout
+	if timeout == 0 {
+		timeout = BindAcceptTimeout
+	}
+	peer, err := acceptForBind(lis, req.DstAddr, timeout)
+	if err != nil {
+		_ = req.reply(conn, replyCode(err), nil)
+		return err
+	}
+	defer peer.Close()
+	stopPeer := context.AfterFunc(s.ctx, func() { peer.Close() })
+	defer stopPeer()
+
+	// 第二次回复，告诉客户端连入的目标服务器的地址
+	if err := req.reply(conn, consts.RepSuccess, peer.RemoteAddr()); err != nil {
+		return err
+	}
+	s.logger().Printf("bind %v accepted peer %v", lis.Addr(), peer.RemoteAddr())
+
+	stats, err := relay.Relay(conn, peer, s.cfg.IdleTimeout)
+	s.logger().Printf("bind session from %v with peer %v closed, sent %d bytes, received %d bytes",
+		conn.RemoteAddr(), peer.RemoteAddr(), stats.AToB, stats.BToA)
+	return err
+}
+
+// listenForBind 在客户端连接所在的本地 IP 上监听一个随机端口
+func listenForBind(conn net.Conn) (*net.TCPListener, error) {
+	laddr := &net.TCPAddr{}
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = tcpAddr.IP
+	}
+
+	return net.ListenTCP("tcp", laddr)
+}
+
+// acceptForBind 等待一个来自 dstAddr 的连接，超时或地址不匹配时返回错误
+func acceptForBind(lis *net.TCPListener, dstAddr string, timeout time.Duration) (net.Conn, error) {
+	if err := lis.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	allowed, err := bindAllowedIPs(dstAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := lis.AcceptTCP()
+	if err != nil {
+		return nil, fmt.Errorf("bind accept error: %w", err)
+	}
+
+	if allowed == nil {
+		return peer, nil
+	}
+
+	peerIP := peer.RemoteAddr().(*net.TCPAddr).IP
+	for _, ip := range allowed {
+		if ip.Equal(peerIP) {
+			return peer, nil
+		}
+	}
+
+	peer.Close()
+	return nil, fmt.Errorf("bind peer %v does not match DST.ADDR %v: %w", peerIP, dstAddr, ErrNotAllowed)
+}
+
+// bindAllowedIPs 返回 DST.ADDR 对应的 IP 列表，返回 nil 表示不限制
+func bindAllowedIPs(dstAddr string) ([]net.IP, error) {
+	if ip := net.ParseIP(dstAddr); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+
+	ips, err := net.LookupIP(dstAddr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve bind DST.ADDR %v error: %w", dstAddr, err)
+	}
+	return ips, nil
+}
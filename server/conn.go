@@ -1,40 +1,57 @@
 package server
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
+	"context"
 	"io"
 	"net"
+	"strconv"
 
 	"zz.io/cargo/so5/consts"
-	"zz.io/cargo/so5/util"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/relay"
 )
 
-func handlerConnectCmd(conn net.Conn, addr, port string, f func(conn net.Conn, err error) error) (err error) {
+// boundAddrer Config.Dial 返回的连接实现该接口时，CONNECT 回复中的 BND 使用 BoundAddr 而不是 LocalAddr，
+// 例如经由上游 socks5 server 建立的连接，BoundAddr 为上游回复中的 BND
+type boundAddrer interface {
+	BoundAddr() net.Addr
+}
+
+// handleConnect 处理 CONNECT 命令，回复的 BND.ADDR/BND.PORT 为服务端连接目标时使用的本地地址，
+// 参见 boundAddrer
+func (s *Server) handleConnect(conn net.Conn, req *Request) error {
 	// 获取目的服务器的连接
-	targetConn, err := net.Dial("tcp", net.JoinHostPort(addr, port))
-	// write reply to client
-	if err := f(conn, err); err != nil {
+	targetConn, err := s.dial(s.ctx, "tcp", net.JoinHostPort(req.DstAddr, req.DstPort))
+	if err != nil {
+		_ = req.reply(conn, replyCode(err), nil)
 		return err
 	}
 
-	defer conn.Close()
-	defer targetConn.Close()
-
-	go func() {
-		_, er := io.Copy(targetConn, conn)
-		if er != nil {
-			err = er
-			return
-		}
-	}()
+	bndAddr := targetConn.LocalAddr()
+	if b, ok := targetConn.(boundAddrer); ok {
+		bndAddr = b.BoundAddr()
+	}
+	// 包装的连接提供 NetConn 时使用底层连接转发，两端都是 TCP 时仍然可以使用 splice
+	if nc, ok := targetConn.(interface{ NetConn() net.Conn }); ok {
+		targetConn = nc.NetConn()
+	}
 
-	if _, err := io.Copy(conn, targetConn); err != nil {
+	// write reply to client
+	if err := req.reply(conn, consts.RepSuccess, bndAddr); err != nil {
+		targetConn.Close()
 		return err
 	}
 
-	return nil
+	defer conn.Close()
+	defer targetConn.Close()
+	// 服务端被强制关闭时同时关闭与目标的连接
+	stop := context.AfterFunc(s.ctx, func() { targetConn.Close() })
+	defer stop()
+
+	stats, err := relay.Relay(conn, targetConn, s.cfg.IdleTimeout)
+	s.logger().Printf("session from %v to %v closed, sent %d bytes, received %d bytes",
+		conn.RemoteAddr(), targetConn.RemoteAddr(), stats.AToB, stats.BToA)
+	return err
 }
 
 // SOCKS 的请求构成如下：（参见 RFC 1928，4. Requests）
@@ -49,34 +66,13 @@ func handlerConnectCmd(conn net.Conn, addr, port string, f func(conn net.Conn, e
 // ATYP		地址类型，0x01=IPv4，0x03=域名，0x04=IPv6
 // DST.ADDR	目标地址
 // DST.PORT	目标端口，2 字节，网络字节序（network octec order）
-func getRequest(conn net.Conn) (cmd byte, addr, port string, err error) {
-	b := make([]byte, 255)
-
-	_, err = io.ReadFull(conn, b[:4])
-	if err != nil {
-		err = fmt.Errorf("read header[VER, CMD, RSV, ATYP] error: %+v", err)
+func getRequest(r io.Reader) (cmd byte, addr, port string, err error) {
+	var req protocol.Request
+	if _, err = req.ReadFrom(r); err != nil {
 		return
 	}
 
-	ver, cmd, rsv, atyp := b[0], b[1], b[2], b[3]
-	if ver != consts.Version {
-		err = fmt.Errorf("invalid version")
-		return
-	}
-
-	_ = rsv // 忽略保留字段
-
-	addr, err = util.ParseAddrFromConn(atyp, conn)
-	if err != nil {
-		return
-	}
-
-	port, err = util.ParsePortFromConn(conn)
-	if err != nil {
-		return
-	}
-
-	return
+	return req.Cmd, req.Addr.Host, strconv.Itoa(int(req.Addr.Port)), nil
 }
 
 // +-----+-----+-------+------+----------+----------+
@@ -104,19 +100,9 @@ func getRequest(conn net.Conn) (cmd byte, addr, port string, err error) {
 // BND.ADDR 服务器绑定地址
 // BND.PORT	服务器绑定的端口（以网络字节序表示）
 //
-// 传入的 bndPort 需要保证为大端序列
-func replyPayload(rep, atyp byte, bndAddr []byte, bndPort uint16) ([]byte, error) {
-	var b bytes.Buffer
-	b.WriteByte(consts.Version)
-	b.WriteByte(rep)
-	b.WriteByte(0x00) // RSV
-	b.WriteByte(atyp)
-	b.Write(bndAddr)
-	// Write the BND.PORT
-	err := binary.Write(&b, binary.BigEndian, bndPort)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write port: %w", err)
-	}
-
-	return b.Bytes(), nil
+// writeReply 根据 bndAddr 构造回复报文并发送给客户端，bndAddr 为 nil 时使用 0.0.0.0:0
+func writeReply(conn net.Conn, rep byte, bndAddr net.Addr) error {
+	reply := protocol.Reply{Rep: rep, Addr: protocol.AddrFromNet(bndAddr)}
+	_, err := reply.WriteTo(conn)
+	return err
 }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/util/testutil"
+)
+
+func init() {
+	// 解析失败时会打印日志，模糊测试中没有意义
+	log.SetOutput(io.Discard)
+}
+
+func FuzzGetRequest(f *testing.F) {
+	seeds := [][]byte{
+		{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x1f, 0x90},
+		append(append([]byte{0x05, 0x02, 0x00, 0x03, 11}, "example.com"...), 0x01, 0xbb),
+		append(append([]byte{0x05, 0x03, 0x00, 0x04}, net.IPv6loopback...), 0x00, 0x50),
+		append(append([]byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("::ffff:10.0.0.1")...), 0x00, 0x50),
+		{0x05, 0x01, 0x00, 0x03, 0x00, 0x00, 0x50},         // 空域名
+		{0x04, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x1f, 0x90}, // 版本错误
+		{0x05, 0x01, 0x01, 0x01, 127, 0, 0, 1, 0x1f, 0x90}, // RSV 不为 0
+		{0x05, 0x01, 0x00, 0x09, 127, 0, 0, 1, 0x1f, 0x90}, // 未知的 ATYP
+		{0x05, 0x01, 0x00, 0x03, 0xff, 'a'},                // 域名长度超过剩余数据
+		{0x05, 0x01, 0x00, 0x01, 127, 0},                   // 截断
+		{},
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		var (
+			cmd        byte
+			addr, port string
+			err        error
+		)
+		testutil.AssertBoundedAlloc(t, testutil.MaxParseAlloc, func() {
+			cmd, addr, port, err = getRequest(r)
+		})
+		if err != nil {
+			return
+		}
+
+		// 被接受的报文重新编码后应当与读取的字节完全相同
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			t.Fatalf("invalid port %q", port)
+		}
+		req := protocol.Request{Cmd: cmd, Addr: protocol.Addr{Type: data[3], Host: addr, Port: uint16(p)}}
+		b, err := req.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() of %+v error = %v", req, err)
+		}
+		if read := data[:len(data)-r.Len()]; !bytes.Equal(b, read) {
+			t.Fatalf("re-encoded %v, read %v", b, read)
+		}
+	})
+}
+
+func FuzzGetUnamePwd(f *testing.F) {
+	seeds := [][]byte{
+		append(append([]byte{0x01, 4}, "root"...), append([]byte{4}, "root"...)...),
+		append(append([]byte{0x01, 255}, bytes.Repeat([]byte{'u'}, 255)...), append([]byte{255}, bytes.Repeat([]byte{'p'}, 255)...)...),
+		{0x01, 0, 0}, // 空用户名和密码
+		append(append([]byte{0x05, 4}, "root"...), append([]byte{4}, "root"...)...), // 旧版本客户端
+		append(append([]byte{0x02, 4}, "root"...), append([]byte{4}, "root"...)...), // 版本错误
+		{0x01, 4, 'r', 'o'},           // 截断的用户名
+		{0x01, 1, 'r', 200, 'p', 'w'}, // 密码长度超过剩余数据
+		{},
+	}
+	for _, s := range seeds {
+		f.Add(s, false)
+		f.Add(s, true)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, acceptLegacy bool) {
+		r := bytes.NewReader(data)
+		var (
+			ver        byte
+			uname, pwd string
+			err        error
+		)
+		testutil.AssertBoundedAlloc(t, testutil.MaxParseAlloc, func() {
+			ver, uname, pwd, err = getUnamePwd(r, acceptLegacy)
+		})
+		if err != nil {
+			return
+		}
+		if ver != consts.UserPassVersion && !(acceptLegacy && ver == consts.Version) {
+			t.Fatalf("accepted version %#x, acceptLegacy %v", ver, acceptLegacy)
+		}
+
+		req := protocol.UserPassRequest{Version: ver, Username: uname, Password: pwd}
+		b, err := req.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() of %+v error = %v", req, err)
+		}
+		if read := data[:len(data)-r.Len()]; !bytes.Equal(b, read) {
+			t.Fatalf("re-encoded %v, read %v", b, read)
+		}
+	})
+}
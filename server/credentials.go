@@ -0,0 +1,121 @@
+package server
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zz.io/cargo/so5/htpasswd"
+)
+
+// CredentialsReloadInterval FileCredentials 检查文件是否变化的间隔
+const CredentialsReloadInterval = 2 * time.Second
+
+// FileCredentials 从 htpasswd 格式的文件中加载用户，文件变化时自动重新加载。
+// 重新加载只影响之后的认证，已经建立的会话不受影响；
+// 新文件解析失败时继续使用旧的内容。
+type FileCredentials struct {
+	path string
+	file atomic.Pointer[htpasswd.File]
+
+	modTime time.Time
+	size    int64
+
+	// logger 由 SetLogger 设置，为 nil 时使用 log.Default()
+	logger atomic.Pointer[log.Logger]
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFileCredentials 加载 path 并开始监听文件变化，不再使用时需要调用 Close
+func NewFileCredentials(path string) (*FileCredentials, error) {
+	c, err := loadFileCredentials(path)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.watch()
+	return c, nil
+}
+
+// loadFileCredentials 加载 path，不监听文件变化
+func loadFileCredentials(path string) (*FileCredentials, error) {
+	c := &FileCredentials{
+		path: path,
+		done: make(chan struct{}),
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := htpasswd.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	c.file.Store(file)
+	c.modTime, c.size = fi.ModTime(), fi.Size()
+	return c, nil
+}
+
+func (c *FileCredentials) Valid(username, password string) bool {
+	return c.file.Load().Verify(username, password)
+}
+
+// SetLogger 设置重新加载文件时使用的日志，server.New 会把 Config.Logger 设置给 Auths 中使用的 FileCredentials
+func (c *FileCredentials) SetLogger(l *log.Logger) {
+	c.logger.Store(l)
+}
+
+func (c *FileCredentials) logf(format string, v ...any) {
+	if l := c.logger.Load(); l != nil {
+		l.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Close 停止监听文件变化
+func (c *FileCredentials) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+// watch 定期检查文件的修改时间和大小，变化时重新加载。
+// 使用轮询而不是 inotify，这样通过 rename 替换文件、网络文件系统等场景也能正常工作
+func (c *FileCredentials) watch() {
+	ticker := time.NewTicker(CredentialsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.reloadIfChanged()
+		}
+	}
+}
+
+func (c *FileCredentials) reloadIfChanged() {
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		c.logf("stat credentials file %v error: %v", c.path, err)
+		return
+	}
+	if fi.ModTime().Equal(c.modTime) && fi.Size() == c.size {
+		return
+	}
+
+	file, err := htpasswd.Load(c.path)
+	if err != nil {
+		c.logf("reload credentials file %v error, keep using the old one: %v", c.path, err)
+		return
+	}
+	c.file.Store(file)
+	c.modTime, c.size = fi.ModTime(), fi.Size()
+	c.logf("reloaded credentials file %v, %d users", c.path, len(file.Entries()))
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/htpasswd"
+)
+
+func TestFileCredentialsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsers := func(content string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// 修改时间的精度可能很低，显式设置保证每次写入都能被发现
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func(password string) string {
+		h, err := htpasswd.Hash(htpasswd.Bcrypt, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	now := time.Now()
+	writeUsers("alice:"+hash("old")+"\n", now)
+	// 不启动 watch，由测试调用 reloadIfChanged
+	c, err := loadFileCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Valid("alice", "old") {
+		t.Fatal("Valid(alice, old) = false, want true")
+	}
+
+	// 重新加载的日志输出到服务端的 Config.Logger
+	var logs bytes.Buffer
+	New(Config{Logger: log.New(&logs, "", 0), Auths: []Authenticator{UserPassAuth{Store: c}}})
+
+	writeUsers("alice:"+hash("new")+"\n", now.Add(time.Second))
+	c.reloadIfChanged()
+	if !c.Valid("alice", "new") || c.Valid("alice", "old") {
+		t.Fatal("password not updated after reload")
+	}
+	if !strings.Contains(logs.String(), "reloaded credentials file") {
+		t.Fatalf("reload not logged to Config.Logger, got %q", logs.String())
+	}
+
+	// 解析失败时继续使用旧的内容
+	writeUsers("alice\n", now.Add(2*time.Second))
+	c.reloadIfChanged()
+	if !c.Valid("alice", "new") {
+		t.Fatal("malformed file replaced the previous credentials")
+	}
+
+	// 文件被删除时同样保留旧的内容
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	c.reloadIfChanged()
+	if !c.Valid("alice", "new") {
+		t.Fatal("removed file dropped the previous credentials")
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"zz.io/cargo/so5/consts"
+)
+
+// ErrNoCredentials HTTP 代理请求中没有 Proxy-Authorization
+var ErrNoCredentials = errors.New("proxy credentials required")
+
+// BasicAuthenticator 可以校验 HTTP 代理请求中 Proxy-Authorization（Basic）的认证方式。
+//
+// 服务端按 Config.Auths 的顺序尝试实现了该接口的认证方式，与 SOCKS5 的方法协商一致：
+// 客户端提供了用户名/密码时相当于同时支持无需认证和用户名/密码，否则只支持无需认证。
+// 返回 ErrNoCredentials 表示该方式需要客户端提供用户名/密码，服务端继续尝试下一个；
+// 返回其他错误表示认证失败。没有任何方式接受时回复 407。
+type BasicAuthenticator interface {
+	Authenticator
+	// AuthenticateBasic 校验 Proxy-Authorization 中的用户名和密码，客户端没有提供时 ok 为 false
+	AuthenticateBasic(username, password string, ok bool) (identity string, err error)
+}
+
+// AuthenticateBasic 接受任何请求，不返回身份
+func (NoAuth) AuthenticateBasic(username, password string, ok bool) (string, error) { return "", nil }
+
+// AuthenticateBasic 使用 Store 校验用户名和密码，身份为用户名
+func (a UserPassAuth) AuthenticateBasic(username, password string, ok bool) (string, error) {
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	if a.Store != nil && a.Store.Valid(username, password) {
+		return username, nil
+	}
+	return "", ErrAuthFailed
+}
+
+// isHTTPMethod 第一个字节是否可能是 HTTP 请求行的开头（方法名都是大写字母）
+func isHTTPMethod(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// serveHTTP 将连接作为 HTTP 代理处理：
+//   - CONNECT 与 SOCKS5 的 CONNECT 命令相同，连接目标后在两端之间转发数据
+//   - 其他方法的请求行必须是绝对 URI（http://host/path），服务端将请求转发给目标并返回响应，
+//     同一个连接上可以发送多个请求
+//
+// 认证使用 Proxy-Authorization，失败时回复 407；AllowRequest 拒绝时回复 403
+func (s *Server) serveHTTP(conn net.Conn, hs net.Conn) {
+	br := bufio.NewReader(hs)
+
+	// 转发普通 HTTP 请求时使用，与目标的连接只在同一个客户端连接内复用
+	tr := &http.Transport{
+		DialContext:        s.dial,
+		DisableCompression: true,
+	}
+	defer tr.CloseIdleConnections()
+
+	for first := true; ; first = false {
+		if !first {
+			if s.shuttingDown() {
+				return
+			}
+			// 等待下一个请求时使用空闲超时
+			if s.cfg.IdleTimeout > 0 {
+				_ = conn.SetReadDeadline(time.Now().Add(s.cfg.IdleTimeout))
+			}
+		}
+
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			if first {
+				s.logHandshakeError(conn, err)
+			}
+			return
+		}
+
+		req, status := s.httpRequest(conn, r)
+		if status != http.StatusOK {
+			s.logger().Printf("http proxy request %v %v from %v rejected: %d", r.Method, r.Host, conn.RemoteAddr(), status)
+			_ = writeHTTPStatus(conn, status)
+			return
+		}
+		// 握手完成，之后的超时由转发自行处理
+		_ = conn.SetDeadline(time.Time{})
+
+		if r.Method == http.MethodConnect {
+			// 客户端可能在收到 200 之前就发送了隧道中的数据，这部分已经读入 br，需要先转发
+			tunnel := conn
+			if n := br.Buffered(); n > 0 {
+				buffered, _ := br.Peek(n)
+				tunnel = &prefixConn{Conn: conn, prefix: buffered}
+			}
+			s.handleRequest(tunnel, req)
+			return
+		}
+
+		if !s.forwardHTTP(conn, tr, r, req) {
+			return
+		}
+	}
+}
+
+// httpRequest 校验 HTTP 代理请求的认证信息和目标地址，转换为 Request，
+// 失败时返回对应的 HTTP 状态码
+func (s *Server) httpRequest(conn net.Conn, r *http.Request) (*Request, int) {
+	var host, port string
+	if r.Method == http.MethodConnect {
+		var err error
+		if host, port, err = net.SplitHostPort(r.Host); err != nil {
+			return nil, http.StatusBadRequest
+		}
+	} else {
+		if r.URL.Scheme != "http" || r.URL.Host == "" {
+			return nil, http.StatusBadRequest
+		}
+		host, port = r.URL.Hostname(), r.URL.Port()
+		if port == "" {
+			port = "80"
+		}
+	}
+
+	auth, err := s.authenticateBasic(r)
+	if err != nil {
+		s.logger().Printf("http proxy client %v auth failed: %v", conn.RemoteAddr(), err)
+		return nil, http.StatusProxyAuthRequired
+	}
+
+	return &Request{
+		Cmd:        consts.CmdConnect,
+		DstAddr:    host,
+		DstPort:    port,
+		RemoteAddr: conn.RemoteAddr(),
+		Auth:       auth,
+		reply:      writeHTTPConnectReply,
+	}, http.StatusOK
+}
+
+// authenticateBasic 按 Config.Auths 的顺序使用实现了 BasicAuthenticator 的认证方式校验请求
+func (s *Server) authenticateBasic(r *http.Request) (AuthInfo, error) {
+	auths := s.cfg.Auths
+	if len(auths) == 0 {
+		auths = []Authenticator{NoAuth{}}
+	}
+
+	// http.Request.BasicAuth 只读取 Authorization，这里借用它解析 Proxy-Authorization
+	h := http.Header{"Authorization": r.Header["Proxy-Authorization"]}
+	username, password, ok := (&http.Request{Header: h}).BasicAuth()
+
+	for _, a := range auths {
+		ba, isBasic := a.(BasicAuthenticator)
+		if !isBasic {
+			continue
+		}
+		identity, err := ba.AuthenticateBasic(username, password, ok)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return AuthInfo{}, err
+		}
+		return AuthInfo{Method: ba.Method(), Identity: identity}, nil
+	}
+	return AuthInfo{}, ErrNoCredentials
+}
+
+// forwardHTTP 把普通 HTTP 请求转发给目标并把响应写回客户端，返回连接是否可以继续使用
+func (s *Server) forwardHTTP(conn net.Conn, tr *http.Transport, r *http.Request, req *Request) bool {
+	if s.cfg.AllowRequest != nil && !s.cfg.AllowRequest(s.ctx, req) {
+		s.logger().Printf("http proxy request %v %v from %v (identity %q) not allowed",
+			r.Method, r.URL, conn.RemoteAddr(), req.Auth.Identity)
+		_ = writeHTTPStatus(conn, http.StatusForbidden)
+		return false
+	}
+
+	keepAlive := !r.Close
+	r = r.WithContext(s.ctx)
+	r.RequestURI = ""
+	removeHopHeaders(r.Header)
+
+	resp, err := tr.RoundTrip(r)
+	if err != nil {
+		s.logger().Printf("http proxy request %v %v from %v error: %v", r.Method, r.URL, conn.RemoteAddr(), err)
+		_ = writeHTTPStatus(conn, httpStatus(replyCode(err)))
+		return false
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	resp.Close = resp.Close || !keepAlive
+	if err := resp.Write(conn); err != nil {
+		s.logger().Printf("http proxy response %v %v to %v error: %v", r.Method, r.URL, conn.RemoteAddr(), err)
+		return false
+	}
+	s.logger().Printf("http proxy request %v %v from %v: %v", r.Method, r.URL, conn.RemoteAddr(), resp.Status)
+	return !resp.Close
+}
+
+// hopHeaders 只对单个连接有效、代理不应转发的首部（参见 RFC 9110，7.6.1）
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// writeHTTPConnectReply 将 SOCKS5 的 REP 转换为 CONNECT 的响应，成功时回复 200，bndAddr 不使用
+func writeHTTPConnectReply(conn net.Conn, rep byte, bndAddr net.Addr) error {
+	if rep == consts.RepSuccess {
+		_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+	return writeHTTPStatus(conn, httpStatus(rep))
+}
+
+// writeHTTPStatus 回复没有内容的响应，之后服务端会关闭连接；407 时要求客户端使用 Basic 认证
+func writeHTTPStatus(conn net.Conn, status int) error {
+	var header string
+	if status == http.StatusProxyAuthRequired {
+		header = "Proxy-Authenticate: Basic realm=\"so5\"\r\n"
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), header)
+	return err
+}
+
+// httpStatus 将 SOCKS5 的 REP 转换为 HTTP 状态码
+func httpStatus(rep byte) int {
+	switch rep {
+	case consts.RepSuccess:
+		return http.StatusOK
+	case consts.RepNotAllowed:
+		return http.StatusForbidden
+	case consts.RepTTLExpired:
+		return http.StatusGatewayTimeout
+	case consts.RepCmdNotSupported:
+		return http.StatusMethodNotAllowed
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/relay"
+)
+
+// RemoteClaimTimeout 远程端口转发连入的连接等待客户端认领的最长时间，超时后关闭该连接
+const RemoteClaimTimeout = 30 * time.Second
+
+// remotePeer 远程端口转发中连入、等待客户端通过 CmdRemoteAccept 认领的连接
+type remotePeer struct {
+	conn     net.Conn
+	owner    net.Listener // 连入的监听，监听关闭时未认领的连接一起关闭
+	identity string       // 发起监听的客户身份，只有相同身份的客户可以认领
+	clientIP string       // 发起监听的客户 IP
+	timer    *time.Timer
+}
+
+// handleRemoteListen 处理私有命令 CmdRemoteListen（远程端口转发），流程为：
+//  1. 服务端按 Config.AllowRemoteForward 检查是否允许，然后在 DST.ADDR:DST.PORT 上监听，
+//     通过第一个回复把监听的地址告诉客户端，这个连接之后作为控制连接
+//  2. 每连入一个连接，服务端在控制连接上发送一个回复，BND 为连入方的地址
+//  3. 客户端新建一个连接，完成认证后发送 CmdRemoteAccept 请求，DST 为收到的连入方地址，
+//     服务端回复成功后在两个连接之间转发数据
+//
+// 控制连接断开时停止监听，尚未被认领的连接随之关闭
+func (s *Server) handleRemoteListen(conn net.Conn, req *Request) error {
+	addr := net.JoinHostPort(req.DstAddr, req.DstPort)
+	if s.cfg.AllowRemoteForward == nil || !s.cfg.AllowRemoteForward(s.ctx, req) {
+		_ = req.reply(conn, replyCode(ErrNotAllowed), nil)
+		return fmt.Errorf("remote forward on %v (identity %q): %w", addr, req.Auth.Identity, ErrNotAllowed)
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = req.reply(conn, replyCode(err), nil)
+		return fmt.Errorf("remote forward listen error: %w", err)
+	}
+	defer lis.Close()
+	// 服务端被强制关闭时停止监听
+	stop := context.AfterFunc(s.ctx, func() { lis.Close() })
+	defer stop()
+	defer s.dropRemotePeers(lis)
+
+	if err := req.reply(conn, consts.RepSuccess, lis.Addr()); err != nil {
+		return err
+	}
+	s.logger().Printf("remote forward %v opened for client %v (identity %q)", lis.Addr(), conn.RemoteAddr(), req.Auth.Identity)
+
+	// 控制连接上不再有客户端发来的数据，读到 EOF 或出错说明客户端已断开
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		lis.Close()
+	}()
+
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	for {
+		peer, err := lis.Accept()
+		if err != nil {
+			s.logger().Printf("remote forward %v closed", lis.Addr())
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		s.addRemotePeer(&remotePeer{conn: peer, owner: lis, identity: req.Auth.Identity, clientIP: clientIP})
+		if err := req.reply(conn, consts.RepSuccess, peer.RemoteAddr()); err != nil {
+			return err
+		}
+	}
+}
+
+// handleRemoteAccept 处理私有命令 CmdRemoteAccept，认领 DST.ADDR:DST.PORT 连入的连接并开始转发
+func (s *Server) handleRemoteAccept(conn net.Conn, req *Request) error {
+	peer, err := s.claimRemotePeer(conn, req)
+	if err != nil {
+		_ = req.reply(conn, replyCode(err), nil)
+		return err
+	}
+	defer peer.Close()
+	stop := context.AfterFunc(s.ctx, func() { peer.Close() })
+	defer stop()
+
+	if err := req.reply(conn, consts.RepSuccess, peer.RemoteAddr()); err != nil {
+		return err
+	}
+
+	stats, err := relay.Relay(conn, peer, s.cfg.IdleTimeout)
+	s.logger().Printf("remote forward session from %v with peer %v closed, sent %d bytes, received %d bytes",
+		conn.RemoteAddr(), peer.RemoteAddr(), stats.AToB, stats.BToA)
+	return err
+}
+
+// addRemotePeer 记录等待认领的连接，RemoteClaimTimeout 内没有被认领时关闭
+func (s *Server) addRemotePeer(p *remotePeer) {
+	key := protocol.AddrFromNet(p.conn.RemoteAddr()).String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.timer = time.AfterFunc(RemoteClaimTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.remotePeers[key] == p {
+			delete(s.remotePeers, key)
+			p.conn.Close()
+		}
+	})
+	s.remotePeers[key] = p
+}
+
+// claimRemotePeer 取出 req 指定的连接，只有发起监听的客户（身份和 IP 都相同）可以认领
+func (s *Server) claimRemotePeer(conn net.Conn, req *Request) (net.Conn, error) {
+	key := net.JoinHostPort(req.DstAddr, req.DstPort)
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.remotePeers[key]
+	if p == nil || p.identity != req.Auth.Identity || p.clientIP != clientIP {
+		return nil, fmt.Errorf("no pending remote forward connection from %v for client %v: %w", key, conn.RemoteAddr(), ErrNotAllowed)
+	}
+	delete(s.remotePeers, key)
+	p.timer.Stop()
+	return p.conn, nil
+}
+
+// dropRemotePeers 关闭 lis 上连入但尚未被认领的连接
+func (s *Server) dropRemotePeers(lis net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, p := range s.remotePeers {
+		if p.owner == lis {
+			delete(s.remotePeers, key)
+			p.timer.Stop()
+			p.conn.Close()
+		}
+	}
+}
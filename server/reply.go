@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+)
+
+var (
+	// ErrNotAllowed 请求被服务端的规则拒绝，回复 REP 0x02
+	ErrNotAllowed = errors.New("connection not allowed by ruleset")
+	// ErrCmdNotSupported 不支持的 CMD，回复 REP 0x07
+	ErrCmdNotSupported = errors.New("command not supported")
+)
+
+// replyCoder 由上游 socks5 server 的回复产生的错误（例如 client.ReplyError），
+// 经由上游转发时（例如 client.NewLocalServer）把上游的 REP 原样回复给客户端
+type replyCoder interface {
+	ReplyCode() byte
+}
+
+// replyCode 将处理请求时遇到的错误（主要是 net.Dial 返回的错误）转换为回复报文中的 REP
+func replyCode(err error) byte {
+	if err == nil {
+		return consts.RepSuccess
+	}
+
+	var upstream replyCoder
+	if errors.As(err, &upstream) {
+		return upstream.ReplyCode()
+	}
+
+	switch {
+	case errors.Is(err, ErrNotAllowed),
+		errors.Is(err, syscall.EACCES),
+		errors.Is(err, syscall.EPERM):
+		return consts.RepNotAllowed
+	case errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, syscall.ENETDOWN):
+		return consts.RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.EHOSTDOWN):
+		return consts.RepHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return consts.RepConnectionRefused
+	case errors.Is(err, syscall.ETIMEDOUT),
+		errors.Is(err, os.ErrDeadlineExceeded):
+		return consts.RepTTLExpired
+	case errors.Is(err, ErrCmdNotSupported):
+		return consts.RepCmdNotSupported
+	case errors.Is(err, protocol.ErrAtypNotSupported):
+		return consts.RepAddrTypeUnsupported
+	}
+
+	// 域名解析失败，目标主机不可达
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return consts.RepTTLExpired
+		}
+		return consts.RepHostUnreachable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return consts.RepTTLExpired
+	}
+
+	return consts.RepFailed
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+)
+
+// upstreamReply 模拟上游 socks5 server 回复的错误
+type upstreamReply byte
+
+func (e upstreamReply) Error() string   { return fmt.Sprintf("REP %d", byte(e)) }
+func (e upstreamReply) ReplyCode() byte { return byte(e) }
+
+func TestReplyCode(t *testing.T) {
+	// dialErr 与 net.Dial 返回的错误结构相同
+	dialErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{name: "nil", err: nil, want: consts.RepSuccess},
+		{name: "not allowed", err: fmt.Errorf("rule: %w", ErrNotAllowed), want: consts.RepNotAllowed},
+		{name: "EACCES", err: dialErr(syscall.EACCES), want: consts.RepNotAllowed},
+		{name: "EPERM", err: dialErr(syscall.EPERM), want: consts.RepNotAllowed},
+		{name: "ENETUNREACH", err: dialErr(syscall.ENETUNREACH), want: consts.RepNetworkUnreachable},
+		{name: "ENETDOWN", err: dialErr(syscall.ENETDOWN), want: consts.RepNetworkUnreachable},
+		{name: "EHOSTUNREACH", err: dialErr(syscall.EHOSTUNREACH), want: consts.RepHostUnreachable},
+		{name: "EHOSTDOWN", err: dialErr(syscall.EHOSTDOWN), want: consts.RepHostUnreachable},
+		{name: "ECONNREFUSED", err: dialErr(syscall.ECONNREFUSED), want: consts.RepConnectionRefused},
+		{name: "ETIMEDOUT", err: dialErr(syscall.ETIMEDOUT), want: consts.RepTTLExpired},
+		{name: "deadline exceeded", err: &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, want: consts.RepTTLExpired},
+		{name: "dns timeout", err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "timeout", Name: "a.invalid", IsTimeout: true}},
+			want: consts.RepTTLExpired},
+		{name: "dns not found", err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "a.invalid", IsNotFound: true}},
+			want: consts.RepHostUnreachable},
+		{name: "cmd not supported", err: fmt.Errorf("cmd 0x09: %w", ErrCmdNotSupported), want: consts.RepCmdNotSupported},
+		{name: "atyp not supported", err: fmt.Errorf("read request: %w", protocol.ErrAtypNotSupported), want: consts.RepAddrTypeUnsupported},
+		{name: "upstream reply", err: fmt.Errorf("dial upstream: %w", upstreamReply(consts.RepConnectionRefused)),
+			want: consts.RepConnectionRefused},
+		{name: "unknown", err: errors.New("something went wrong"), want: consts.RepFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyCode(tt.err); got != tt.want {
+				t.Fatalf("replyCode(%v) = %#x, want %#x", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,86 +1,401 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
 	"net"
-	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/relay"
 )
 
-func ListenAndServer(addr string) error {
-	lis, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Println(err)
-		return err
+// ErrServerClosed Shutdown 之后 Serve 和 ListenAndServe 返回该错误
+var ErrServerClosed = errors.New("so5: server closed")
+
+// Config 服务端的配置，零值可用：无需认证、使用 net.Dialer 连接目标、日志输出到 log.Default()
+type Config struct {
+	// Auths 服务端可接受的认证方式，按优先级排列，为空时不需要认证
+	Auths []Authenticator
+
+	// HandshakeTimeout 从连接建立到读完请求（方法协商、认证、请求）的最长时间，为 0 时不限制
+	HandshakeTimeout time.Duration
+
+	// DialTimeout 连接 CONNECT 命令的目标的最长时间，为 0 时不限制
+	DialTimeout time.Duration
+
+	// IdleTimeout 转发数据时的空闲超时，两个方向都超过该时间没有数据时关闭连接，为 0 时不限制。
+	// Linux 上两端都是 TCP 的转发无论是否设置都会使用 splice(2) 零拷贝
+	IdleTimeout time.Duration
+
+	// BindTimeout BIND 命令等待目标服务器连入的最长时间，为 0 时使用 BindAcceptTimeout
+	BindTimeout time.Duration
+
+	// Dial 用于连接 CONNECT 命令的目标，为 nil 时使用 net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logger 为 nil 时使用 log.Default()。
+	// 不为 nil 时 New 会把它设置给 Auths 中 UserPassAuth 使用的 FileCredentials 等支持 SetLogger 的 Store
+	Logger *log.Logger
+
+	// AllowRequest 在处理每个请求之前调用，返回 false 时回复 REP 0x02（规则不允许）并断开连接，
+	// 为 nil 时允许所有请求
+	AllowRequest func(ctx context.Context, req *Request) bool
+
+	// AllowRemoteForward 决定是否允许客户端通过私有命令 CmdRemoteListen 让服务端
+	// 在 req.DstAddr:req.DstPort 上监听（远程端口转发），在 AllowRequest 之后调用，
+	// 为 nil 时不允许远程端口转发
+	AllowRemoteForward func(ctx context.Context, req *Request) bool
+}
+
+// Request 客户端发来的请求
+type Request struct {
+	Version    byte     // 0x05 或 0x04（SOCKS4/4a），HTTP 代理的请求为 0
+	Cmd        byte     // CONNECT、BIND 或 UDP ASSOCIATE
+	DstAddr    string   // DST.ADDR，IPv4、IPv6 或域名，不带方括号
+	DstPort    string   // DST.PORT
+	RemoteAddr net.Addr // 客户端的地址
+	Auth       AuthInfo // 客户端认证时选定的方式以及认证得到的身份
+
+	// reply 按请求所用的协议向客户端发送回复，bndAddr 为 nil 时使用 0.0.0.0:0
+	reply func(conn net.Conn, rep byte, bndAddr net.Addr) error
+}
+
+// Server socks5 服务端，使用 New 创建
+type Server struct {
+	cfg Config
+
+	// ctx 在 Shutdown 超时后被取消，用于中断所有连接上正在进行的操作
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup // 正在处理的连接
+
+	// remotePeers 远程端口转发中等待认领的连接，key 为连入方的地址，由 mu 保护
+	remotePeers map[string]*remotePeer
+}
+
+// New 根据 cfg 创建服务端
+func New(cfg Config) *Server {
+	if cfg.Logger != nil {
+		for _, a := range cfg.Auths {
+			if up, ok := a.(UserPassAuth); ok {
+				if l, ok := up.Store.(interface{ SetLogger(*log.Logger) }); ok {
+					l.SetLogger(cfg.Logger)
+				}
+			}
+		}
 	}
-	defer lis.Close()
 
-	// 走到这里说明连接建立成功，这代表 addr 没有问题
-	addrPort, err := netip.ParseAddrPort(addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		cfg:       cfg,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+
+		remotePeers: make(map[string]*remotePeer),
+	}
+}
+
+// ListenAndServer 监听 addr 并为每个连接执行完整的 RFC 1928 流程：
+// 方法协商 -> 子协商（认证）-> 请求 -> 转发。
+// auths 为服务端可接受的认证方式，按优先级排列，为空时不需要认证。
+func ListenAndServer(addr string, auths ...Authenticator) error {
+	return New(Config{Auths: auths}).ListenAndServe(addr)
+}
+
+// ListenAndServe 监听 addr 并调用 Serve
+func (s *Server) ListenAndServe(addr string) error {
+	lis, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Println(err)
+		s.logger().Println(err)
 		return err
 	}
 
-	atypeFunc := func(addr string) byte {
-		switch {
-		case addrPort.Addr().Is4():
-			return consts.AtypIPv4
-		case addrPort.Addr().Is6():
-			return consts.AtypIpv6
-		default: // 因为 addr 没有问题，所以这里会是域名
-			return consts.AtypDomain
-		}
-	}
+	return s.Serve(lis)
+}
 
-	writeReplyPayloadFunc := func(conn net.Conn, dialTargetErr error) error {
-		var rep byte
-		// TODO: 暂时只支持 0x00 和 0x01
-		switch dialTargetErr {
-		case nil:
-			rep = consts.RepSuccess
-		default:
-			rep = consts.RepFailed
-		}
+// Serve 在 lis 上接受连接并处理，直到 lis 出错或 Shutdown 被调用，返回时 lis 已被关闭。
+// Shutdown 之后返回 ErrServerClosed
+func (s *Server) Serve(lis net.Listener) error {
+	if !s.trackListener(lis, true) {
+		lis.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(lis, false)
+	defer lis.Close()
 
-		payload, err := replyPayload(rep, atypeFunc(addr), addrPort.Addr().AsSlice(), addrPort.Port())
+	var tempDelay time.Duration // 临时错误（如文件描述符耗尽）时的退避时间
+	for {
+		conn, err := lis.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() || errors.Is(err, syscall.EMFILE) {
+				tempDelay = min(max(2*tempDelay, 5*time.Millisecond), time.Second)
+				s.logger().Printf("accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			s.logger().Println(err)
 			return err
 		}
+		tempDelay = 0
 
-		_, err = conn.Write(payload)
-		if err != nil {
-			return err
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			continue
 		}
 
-		return dialTargetErr
+		go func() {
+			defer s.wg.Done()
+			defer s.trackConn(conn, false)
+			defer conn.Close()
+
+			s.serveConn(conn)
+		}()
 	}
+}
 
-	for {
-		conn, err := lis.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
+// Shutdown 优雅地关闭服务端：首先停止接受新连接，然后等待正在处理的连接结束；
+// ctx 结束时仍未结束的连接会被强制关闭，此时返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for lis := range s.listeners {
+		lis.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.cancel()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+
+	return ctx.Err()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	if s.cfg.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.cfg.HandshakeTimeout))
+	}
+
+	// 根据第一个字节（VER）区分协议，同一个端口同时支持 SOCKS5、SOCKS4/4a 和 HTTP 代理；
+	// 读出的字节通过 prefixConn 交还给握手的解析
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		s.logHandshakeError(conn, err)
+		return
+	}
+	hs := &prefixConn{Conn: conn, prefix: ver}
+
+	var req *Request
+	switch {
+	case ver[0] == consts.Version:
+		req = s.socks5Handshake(hs)
+	case ver[0] == consts.Socks4Version:
+		req = s.socks4Handshake(hs)
+	case isHTTPMethod(ver[0]):
+		s.serveHTTP(conn, hs)
+		return
+	default:
+		s.logger().Printf("handshake with %v failed: unknown version %#x", conn.RemoteAddr(), ver[0])
+		return
+	}
+	if req == nil {
+		return
+	}
+
+	// 握手完成，之后的超时由各个命令自行处理
+	_ = conn.SetDeadline(time.Time{})
+
+	s.handleRequest(conn, req)
+}
+
+// socks5Handshake 完成 SOCKS5 的方法协商、认证并读取请求，失败时返回 nil
+func (s *Server) socks5Handshake(conn net.Conn) *Request {
+	// 没有可接受的认证方式或认证失败时，返回后连接会被关闭
+	auth, er := Negotiate(conn, s.cfg.Auths...)
+	if er != nil {
+		s.logHandshakeError(conn, er)
+		return nil
+	}
+	s.logger().Printf("client %v authenticated with method %#x, identity %q", conn.RemoteAddr(), auth.Method, auth.Identity)
+
+	cmd, addr, port, er := getRequest(conn)
+	if er != nil {
+		s.logHandshakeError(conn, er)
+		// 地址类型不支持时需要告诉客户端，其余错误（如版本号不对）直接断开
+		if errors.Is(er, protocol.ErrAtypNotSupported) {
+			_ = writeReply(conn, replyCode(er), nil)
 		}
+		return nil
+	}
 
-		go func() {
-			cmd, addr, port, er := getRequest(conn)
-			if er != nil {
-				log.Println(er)
-				return
-			}
+	return &Request{
+		Version:    consts.Version,
+		Cmd:        cmd,
+		DstAddr:    addr,
+		DstPort:    port,
+		RemoteAddr: conn.RemoteAddr(),
+		Auth:       auth,
+		reply:      writeReply,
+	}
+}
 
-			switch cmd {
-			case consts.CmdConnect:
-				if err := handlerConnectCmd(conn, addr, port, writeReplyPayloadFunc); err != nil {
-					log.Println(err)
-					return
-				}
-			case consts.CmdBind:
-			case consts.CmdUdp:
+// handleRequest 检查请求是否被允许，然后交给对应的命令处理
+func (s *Server) handleRequest(conn net.Conn, req *Request) {
+	dst := net.JoinHostPort(req.DstAddr, req.DstPort)
+	if s.cfg.AllowRequest != nil && !s.cfg.AllowRequest(s.ctx, req) {
+		s.logger().Printf("request cmd %#x to %v from %v (identity %q) not allowed",
+			req.Cmd, dst, conn.RemoteAddr(), req.Auth.Identity)
+		_ = req.reply(conn, replyCode(ErrNotAllowed), nil)
+		return
+	}
 
-			}
-		}()
+	var err error
+	switch {
+	case req.Cmd == consts.CmdConnect:
+		err = s.handleConnect(conn, req)
+	case req.Cmd == consts.CmdBind:
+		err = s.handleBind(conn, req)
+	case req.Cmd == consts.CmdUdp && req.Version == consts.Version:
+		err = s.handleUdp(conn, req)
+	case req.Cmd == consts.CmdRemoteListen && req.Version == consts.Version:
+		err = s.handleRemoteListen(conn, req)
+	case req.Cmd == consts.CmdRemoteAccept && req.Version == consts.Version:
+		err = s.handleRemoteAccept(conn, req)
+	default:
+		err = ErrCmdNotSupported
+		_ = req.reply(conn, replyCode(err), nil)
+	}
+	if errors.Is(err, relay.ErrIdleTimeout) {
+		s.logger().Printf("session from %v to %v closed: idle for %v", conn.RemoteAddr(), dst, s.cfg.IdleTimeout)
+	} else if err != nil {
+		s.logger().Printf("cmd %#x from %v error: %v", req.Cmd, conn.RemoteAddr(), err)
+	}
+}
+
+// logHandshakeError 记录握手失败的原因，超时单独说明
+func (s *Server) logHandshakeError(conn net.Conn, err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		s.logger().Printf("handshake with %v closed: not completed within %v", conn.RemoteAddr(), s.cfg.HandshakeTimeout)
+		return
+	}
+	s.logger().Printf("handshake with %v failed: %v", conn.RemoteAddr(), err)
+}
+
+func (s *Server) logger() *log.Logger {
+	if s.cfg.Logger != nil {
+		return s.cfg.Logger
+	}
+	return log.Default()
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.cfg.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.DialTimeout)
+		defer cancel()
+	}
+
+	if s.cfg.Dial != nil {
+		return s.cfg.Dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackListener 记录或移除 lis，服务端已关闭时不再记录并返回 false
+func (s *Server) trackListener(lis net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, lis)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn 记录或移除 conn，记录成功时 wg 加一，服务端已关闭时不再记录并返回 false
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// prefixConn 先返回 prefix 中已经读出的数据，再从 Conn 读取，
+// 用于把区分协议时读出的 VER 交还给握手的解析
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite 转发时用于半关闭，Conn 不支持时返回 errors.ErrUnsupported，由调用方决定是否直接关闭
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
 	}
+	return errors.ErrUnsupported
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+)
+
+// UserIDAuthenticator 可以校验 SOCKS4 请求中 USERID 字段的认证方式。
+//
+// SOCKS4 没有方法协商，服务端按 Config.Auths 的顺序使用第一个实现了该接口的认证方式，
+// 没有任何认证方式实现该接口时拒绝所有 SOCKS4 请求（回复 0x5b）。
+// NoAuth 实现了该接口并接受任何 USERID；UserPassAuth 没有实现，
+// 因为 USERID 中没有密码，只配置了用户名/密码认证的服务端不会接受 SOCKS4 客户端。
+type UserIDAuthenticator interface {
+	Authenticator
+	// AuthenticateUserID 校验 USERID，返回客户的身份，校验失败时返回错误
+	AuthenticateUserID(userID string) (identity string, err error)
+}
+
+// AuthenticateUserID 接受任何 USERID，不返回身份
+func (NoAuth) AuthenticateUserID(userID string) (string, error) { return "", nil }
+
+// ErrUserIDRejected 没有认证方式接受 SOCKS4 请求中的 USERID
+var ErrUserIDRejected = errors.New("socks4 userid rejected")
+
+// SOCKS4 的请求构成如下：（参见 SOCKS4 和 SOCKS4A 协议说明）
+// +----+----+---------+--------+--------+------+--------+------+
+// | VN | CD | DSTPORT | DSTIP  | USERID | NULL | DOMAIN | NULL |
+// +----+----+---------+--------+--------+------+--------+------+
+// | 1  | 1  |    2    |   4    | 可变   |  1   | 可变   |  1   |
+// +----+----+---------+--------+--------+------+--------+------+
+// VN		0x04，协议版本号
+// CD		0x01=CONNECT, 0x02=BIND
+// DSTIP	为 0.0.0.x（x 不为 0）时是 SOCKS4A，目标地址为其后的 DOMAIN
+//
+// socks4Handshake 读取 SOCKS4/4a 请求并校验 USERID，失败时返回 nil
+func (s *Server) socks4Handshake(conn net.Conn) *Request {
+	var r protocol.Socks4Request
+	if _, err := r.ReadFrom(conn); err != nil {
+		s.logHandshakeError(conn, err)
+		return nil
+	}
+
+	auth, err := s.authenticateUserID(r.UserID)
+	if err != nil {
+		s.logHandshakeError(conn, err)
+		_ = writeSocks4Reply(conn, consts.RepNotAllowed, nil)
+		return nil
+	}
+	s.logger().Printf("socks4 client %v authenticated with userid %q, identity %q", conn.RemoteAddr(), r.UserID, auth.Identity)
+
+	return &Request{
+		Version:    consts.Socks4Version,
+		Cmd:        r.Cmd,
+		DstAddr:    r.Host(),
+		DstPort:    strconv.Itoa(int(r.Port)),
+		RemoteAddr: conn.RemoteAddr(),
+		Auth:       auth,
+		reply:      writeSocks4Reply,
+	}
+}
+
+// authenticateUserID 使用 Config.Auths 中第一个实现了 UserIDAuthenticator 的认证方式校验 USERID
+func (s *Server) authenticateUserID(userID string) (AuthInfo, error) {
+	auths := s.cfg.Auths
+	if len(auths) == 0 {
+		auths = []Authenticator{NoAuth{}}
+	}
+
+	for _, a := range auths {
+		ua, ok := a.(UserIDAuthenticator)
+		if !ok {
+			continue
+		}
+		identity, err := ua.AuthenticateUserID(userID)
+		if err != nil {
+			return AuthInfo{}, err
+		}
+		return AuthInfo{Method: ua.Method(), Identity: identity}, nil
+	}
+	return AuthInfo{}, ErrUserIDRejected
+}
+
+// +----+----+---------+-------+
+// | VN | CD | DSTPORT | DSTIP |
+// +----+----+---------+-------+
+// | 1  | 1  |    2    |   4   |
+// +----+----+---------+-------+
+// VN		0x00，回复的版本号
+// CD		0x5a 成功，0x5b 请求被拒绝或失败
+//
+// writeSocks4Reply 将 SOCKS5 的 REP 转换为 SOCKS4 的 CD 并发送给客户端，
+// bndAddr 不是 IPv4 地址时 DSTIP 为 0.0.0.0
+func writeSocks4Reply(conn net.Conn, rep byte, bndAddr net.Addr) error {
+	reply := protocol.Socks4Reply{Rep: consts.Socks4RepGranted}
+	if rep != consts.RepSuccess {
+		reply.Rep = consts.Socks4RepRejected
+	}
+
+	if bndAddr != nil {
+		addr := protocol.AddrFromNet(bndAddr)
+		reply.Port = addr.Port
+		if ip, err := netip.ParseAddr(addr.Host); err == nil && ip.Is4() {
+			reply.IP = ip.As4()
+		}
+	}
+
+	_, err := reply.WriteTo(conn)
+	return err
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+)
+
+// maxUDPPacketSize UDP 数据报的最大长度
+const maxUDPPacketSize = 64 * 1024
+
+// handleUdp 处理 UDP ASSOCIATE 命令（参见 RFC 1928，7. Procedure for UDP-based clients）
+//
+// 服务端为每个关联分配两个 UDP socket：
+//   - relayConn 面向客户端，其地址通过回复的 BND.ADDR/BND.PORT 告诉客户端，
+//     客户端发来的数据报带有 UDP 头部，去掉头部后转发给目标
+//   - targetConn 面向目标，目标发回的数据报加上 UDP 头部后转发给客户端
+//
+// 服务端只接受来自控制连接的源 IP 的数据报。请求中的 DST.ADDR/DST.PORT 为客户端发送数据报时将会使用的地址，
+// 为 0 时表示未知：DST.ADDR 为 0 或与源 IP 相同时，DST.PORT 不为 0 则进一步限制为该端口；
+// DST.ADDR 与源 IP 不同时客户端可能位于 NAT 之后，DST.ADDR/DST.PORT 是 NAT 之前的地址，只按源 IP 限制。
+// 控制用的 TCP 连接断开时，关联随之结束。
+func (s *Server) handleUdp(conn net.Conn, req *Request) error {
+	// 经由 Serve 传入的 unix 等监听器接受的连接没有源 IP
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	clientIP := net.ParseIP(host)
+	if clientIP == nil {
+		_ = req.reply(conn, consts.RepFailed, nil)
+		return fmt.Errorf("udp associate: unknown client ip for %v", conn.RemoteAddr())
+	}
+
+	relayConn, err := listenForUdp(conn)
+	if err != nil {
+		_ = req.reply(conn, replyCode(err), nil)
+		return fmt.Errorf("udp associate listen error: %+v", err)
+	}
+	defer relayConn.Close()
+
+	targetConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		_ = req.reply(conn, replyCode(err), nil)
+		return fmt.Errorf("udp associate listen error: %+v", err)
+	}
+	defer targetConn.Close()
+
+	if err := req.reply(conn, consts.RepSuccess, relayConn.LocalAddr()); err != nil {
+		return err
+	}
+	s.logger().Printf("udp associate %v for client %v", relayConn.LocalAddr(), conn.RemoteAddr())
+
+	a := &udpAssociation{
+		logger:     s.logger(),
+		relayConn:  relayConn,
+		targetConn: targetConn,
+		clientIP:   clientIP,
+	}
+	dstIP := net.ParseIP(req.DstAddr)
+	if port, _ := strconv.Atoi(req.DstPort); port != 0 && dstIP != nil && (dstIP.IsUnspecified() || dstIP.Equal(clientIP)) {
+		a.clientAddr = &net.UDPAddr{IP: clientIP, Port: port}
+	}
+
+	go a.serveClient()
+	go a.serveTarget()
+
+	// 控制连接上不会再有数据，读到 EOF 或出错说明客户端已断开
+	_, err = io.Copy(io.Discard, conn)
+	return err
+}
+
+// listenForUdp 在客户端连接所在的本地 IP 上监听一个随机 UDP 端口
+func listenForUdp(conn net.Conn) (*net.UDPConn, error) {
+	laddr := &net.UDPAddr{}
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = tcpAddr.IP
+	}
+
+	return net.ListenUDP("udp", laddr)
+}
+
+type udpAssociation struct {
+	logger     *log.Logger
+	relayConn  *net.UDPConn
+	targetConn *net.UDPConn
+	clientIP   net.IP
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr // 客户端实际发送数据报的地址，收到第一个数据报后确定
+}
+
+// serveClient 读取客户端发来的数据报，去掉头部后转发给目标
+func (a *udpAssociation) serveClient() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, src, err := a.relayConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if !a.acceptClient(src) {
+			a.logger.Printf("udp associate drop datagram from unexpected source %v", src)
+			continue
+		}
+
+		var hdr protocol.UDPHeader
+		hn, err := hdr.ReadFrom(bytes.NewReader(buf[:n]))
+		if err != nil {
+			a.logger.Println(err)
+			continue
+		}
+		// 不支持分片，直接丢弃
+		if hdr.Frag != 0x00 {
+			continue
+		}
+		data := buf[hn:n]
+
+		dst, err := net.ResolveUDPAddr("udp", hdr.Addr.String())
+		if err != nil {
+			a.logger.Println(err)
+			continue
+		}
+
+		if _, err := a.targetConn.WriteToUDP(data, dst); err != nil {
+			a.logger.Println(err)
+		}
+	}
+}
+
+// serveTarget 读取目标发回的数据报，加上头部后转发给客户端
+func (a *udpAssociation) serveTarget() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, src, err := a.targetConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+		// 客户端还未发送过数据报，不知道该回给谁
+		if clientAddr == nil {
+			continue
+		}
+
+		hdr := protocol.UDPHeader{Addr: protocol.AddrFromNet(src)}
+		packet, err := hdr.MarshalBinary()
+		if err != nil {
+			a.logger.Println(err)
+			continue
+		}
+		packet = append(packet, buf[:n]...)
+		if _, err := a.relayConn.WriteToUDP(packet, clientAddr); err != nil {
+			a.logger.Println(err)
+		}
+	}
+}
+
+// acceptClient 判断数据报是否来自关联的客户端，第一个合法的数据报会确定客户端的地址
+func (a *udpAssociation) acceptClient(src *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.clientAddr != nil {
+		return a.clientAddr.IP.Equal(src.IP) && a.clientAddr.Port == src.Port
+	}
+
+	if !a.clientIP.Equal(src.IP) {
+		return false
+	}
+	a.clientAddr = src
+	return true
+}
@@ -1,12 +1,27 @@
 package e2e
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"zz.io/cargo/so5/client"
 	"zz.io/cargo/so5/consts"
 	"zz.io/cargo/so5/server"
+	"zz.io/cargo/so5/util"
+)
+
+const (
+	username = "root"
+	password = "root"
 )
 
 var (
@@ -14,27 +29,46 @@ var (
 	serverNoSupport = []byte{0x10}
 )
 
+var rootAuth = server.UserPassAuth{Store: server.StaticCredentials{username: password}}
+
 func TestAuthClient1(t *testing.T) {
-	runClient(t, serverNoSupport)
+	addr, done := runServer(t, rootAuth)
+	runClient(t, addr, serverNoSupport)
+	if err := <-done; !errors.Is(err, server.ErrNoAcceptableMethod) {
+		t.Fatalf("server NegotiationAuth() error = %v, want %v", err, server.ErrNoAcceptableMethod)
+	}
 }
 
 func TestAuthClient2(t *testing.T) {
-	runClient(t, serverSupport)
+	addr, done := runServer(t, rootAuth)
+	runClient(t, addr, serverSupport)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAuthServerNoRequired(t *testing.T) {
-	runServer(t, consts.AuthTypeNoRequired)
+	addr, done := runServer(t, server.NoAuth{})
+	runClient(t, addr, serverSupport)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAuthServerUnamePwd(t *testing.T) {
-	runServer(t, consts.AuthTypeUnamePwd)
+	addr, done := runServer(t, rootAuth)
+	runClient(t, addr, []byte{consts.AuthTypeUnamePwd})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
 }
 
-func runClient(t *testing.T, supportAuthMethods []byte) {
-	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+func runClient(t *testing.T, addr string, supportAuthMethods []byte) {
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer conn.Close()
 
 	authMethod, err := client.NegotiationAuth(conn, supportAuthMethods)
 	if err != nil {
@@ -45,7 +79,7 @@ func runClient(t *testing.T, supportAuthMethods []byte) {
 	case consts.AuthTypeNoRequired:
 		t.Log("NegotiationAuthMethod: NoRequired")
 	case consts.AuthTypeUnamePwd:
-		if err := client.AuthUseUnamePwd(conn, server.Username, server.Password); err != nil {
+		if err := client.AuthUseUnamePwd(conn, username, password); err != nil {
 			t.Error(err)
 			return
 		}
@@ -54,22 +88,277 @@ func runClient(t *testing.T, supportAuthMethods []byte) {
 	}
 }
 
-func runServer(t *testing.T, authMethod byte) {
-	lis, err := net.Listen("tcp", ":8080")
+// runServer 接受一个连接并完成认证，done 返回 server.NegotiationAuth 的结果
+func runServer(t *testing.T, auth server.Authenticator) (addr string, done <-chan error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer lis.Close()
 
-	conn, err := lis.Accept()
-	if err != nil {
-		t.Error(err)
-		return
+	errCh := make(chan error, 1)
+	go func() {
+		defer lis.Close()
+
+		conn, err := lis.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+
+		errCh <- server.NegotiationAuth(conn, auth)
+	}()
+
+	return lis.Addr().String(), errCh
+}
+
+// funcStore 使用函数实现 server.CredentialStore，模拟使用者自己的用户体系
+type funcStore func(username, password string) bool
+
+func (f funcStore) Valid(username, password string) bool { return f(username, password) }
+
+func TestServerUserPassAuth(t *testing.T) {
+	store := funcStore(func(u, p string) bool { return u == "alice" && p == "secret" })
+
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{server.UserPassAuth{Store: store}}})
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "valid", password: "secret"},
+		{name: "invalid", password: "wrong", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+
+			method, err := client.NegotiationAuth(conn, serverSupport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if method != consts.AuthTypeUnamePwd {
+				t.Fatalf("method = %#x, want %#x", method, consts.AuthTypeUnamePwd)
+			}
+
+			err = client.AuthUseUnamePwd(conn, "alice", tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AuthUseUnamePwd() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
 	}
+}
+
+func TestClientDialWithAuth(t *testing.T) {
+	target := startEchoServer(t)
+
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{rootAuth}})
+	clientAddr := startClient(t, proxyAddr, target, &client.Options{Auth: &client.Auth{Username: username, Password: password}})
+
+	conn := dialRetry(t, clientAddr)
+	defer conn.Close()
+
+	assertEcho(t, conn, "hello auth")
+}
+
+func TestClientNoAcceptableMethod(t *testing.T) {
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{rootAuth}})
+
+	conn := dial(t, proxyAddr)
 	defer conn.Close()
 
-	if err := server.NegotiationAuth(conn, authMethod); err != nil {
-		t.Error(err)
-		return
+	err := client.Authenticate(conn, nil)
+	var noAcceptable *client.NoAcceptableMethodError
+	if !errors.As(err, &noAcceptable) {
+		t.Fatalf("Authenticate() error = %v, want NoAcceptableMethodError", err)
+	}
+}
+
+// TestServerUserPassVersion 按 RFC 1929 子协商的版本号为 0x01（curl、Chrome 等使用该值），
+// 旧版本 so5 客户端使用的 0x05 只有在打开兼容开关时才被接受
+func TestServerUserPassVersion(t *testing.T) {
+	tests := []struct {
+		name         string
+		acceptLegacy bool
+		ver          byte
+		wantReply    []byte // nil 表示服务端直接断开连接
+	}{
+		{name: "rfc1929", ver: consts.UserPassVersion, wantReply: []byte{0x01, consts.AuthUserOk}},
+		{name: "legacy rejected", ver: consts.Version},
+		{name: "legacy accepted", acceptLegacy: true, ver: consts.Version, wantReply: []byte{0x05, consts.AuthUserOk}},
+		{name: "rfc1929 with legacy accepted", acceptLegacy: true, ver: consts.UserPassVersion, wantReply: []byte{0x01, consts.AuthUserOk}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := server.UserPassAuth{Store: rootAuth.Store, AcceptLegacyVersion: tt.acceptLegacy}
+			proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{auth}})
+
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+
+			if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeUnamePwd}); err != nil {
+				t.Fatal(err)
+			}
+
+			// 手工构造请求，模拟不同的客户端
+			req := append(append([]byte{tt.ver, byte(len(username))}, username...), byte(len(password)))
+			if _, err := conn.Write(append(req, password...)); err != nil {
+				t.Fatal(err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			if tt.wantReply == nil {
+				if got, err := io.ReadAll(conn); len(got) != 0 || err != nil {
+					t.Fatalf("reply = %v, %v, want connection closed", got, err)
+				}
+				return
+			}
+			got := make([]byte, 2)
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, tt.wantReply) {
+				t.Fatalf("reply = %v, %v, want %v", got, err, tt.wantReply)
+			}
+		})
+	}
+}
+
+// TestServerMethodPreference 服务端按自己的优先级选出第一个客户端也支持的方式
+func TestServerMethodPreference(t *testing.T) {
+	auths := []server.Authenticator{rootAuth, server.NoAuth{}}
+
+	tests := []struct {
+		name    string
+		offered []byte
+		want    byte
+	}{
+		{name: "both offered", offered: []byte{consts.AuthTypeNoRequired, consts.AuthTypeUnamePwd}, want: consts.AuthTypeUnamePwd},
+		{name: "only none", offered: []byte{consts.AuthTypeNoRequired}, want: consts.AuthTypeNoRequired},
+		{name: "none acceptable", offered: serverNoSupport, want: consts.AuthTypeNoAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: auths})
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+
+			method, err := client.NegotiationAuth(conn, tt.offered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if method != tt.want {
+				t.Fatalf("method = %#x, want %#x", method, tt.want)
+			}
+
+			// 没有可接受的方式时服务端回复 0xFF 后关闭连接
+			if tt.want == consts.AuthTypeNoAcceptable {
+				conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+				if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+					t.Fatalf("Read() = %d, %v, want EOF", n, err)
+				}
+			}
+		})
+	}
+}
+
+// TestServerRequestAuthInfo 请求处理阶段可以拿到认证时选定的方式和客户身份
+func TestServerRequestAuthInfo(t *testing.T) {
+	target := startEchoServer(t)
+
+	got := make(chan server.AuthInfo, 1)
+	cfg := server.Config{
+		Auths: []server.Authenticator{server.UserPassAuth{Store: server.StaticCredentials{"alice": "a", "bob": "b"}}},
+		AllowRequest: func(ctx context.Context, req *server.Request) bool {
+			got <- req.Auth
+			return req.Auth.Identity == "alice"
+		},
+	}
+	proxyAddr := startServer(t, "127.0.0.1:0", cfg)
+
+	tests := []struct {
+		user, pass string
+		rep        byte
+	}{
+		{user: "alice", pass: "a", rep: consts.RepSuccess},
+		{user: "bob", pass: "b", rep: consts.RepNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+
+			if err := client.Authenticate(conn, &client.Auth{Username: tt.user, Password: tt.pass}); err != nil {
+				t.Fatal(err)
+			}
+			atyp, adr, port, err := util.ParseAddr(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.WriteRequest(conn, atyp, adr, port); err != nil {
+				t.Fatal(err)
+			}
+
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				t.Fatal(err)
+			}
+			if b[1] != tt.rep {
+				t.Fatalf("REP = %#x, want %#x", b[1], tt.rep)
+			}
+
+			info := <-got
+			if info.Method != consts.AuthTypeUnamePwd || info.Identity != tt.user {
+				t.Fatalf("Request.Auth = %+v, want method %#x identity %q", info, consts.AuthTypeUnamePwd, tt.user)
+			}
+		})
+	}
+}
+
+// lockedBuffer 可以被服务端的 goroutine 并发写入的 bytes.Buffer
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestServerLoggerAuthFailed 认证失败通过 Config.Logger 记录，不输出到全局的 log
+func TestServerLoggerAuthFailed(t *testing.T) {
+	var logs, global lockedBuffer
+	log.SetOutput(&global)
+	defer log.SetOutput(os.Stderr)
+
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{
+		Auths:  []server.Authenticator{rootAuth},
+		Logger: log.New(&logs, "", 0),
+	})
+
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+	if err := client.Authenticate(conn, &client.Auth{Username: "mallory", Password: "guess"}); !errors.Is(err, client.ErrAuthFailed) {
+		t.Fatalf("Authenticate error = %v, want %v", err, client.ErrAuthFailed)
+	}
+	// 服务端记录日志后关闭连接
+	assertClosedWithin(t, conn, 2*time.Second)
+
+	if !strings.Contains(logs.String(), `"mallory"`) {
+		t.Fatalf("auth failure not logged to Config.Logger, got %q", logs.String())
+	}
+	if strings.Contains(global.String(), "mallory") {
+		t.Fatalf("auth failure logged to the global logger: %q", global.String())
 	}
 }
@@ -0,0 +1,59 @@
+package e2e
+
+import (
+	"net"
+	"testing"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/server"
+)
+
+func TestServerBind(t *testing.T) {
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+		t.Fatal(err)
+	}
+
+	// DST.ADDR 为 127.0.0.1，只允许本机连入
+	err := client.WriteCmdRequest(conn, consts.CmdBind, consts.AtypIPv4, []byte{127, 0, 0, 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次回复：服务端监听的地址
+	_, bndAddr, bndPort, err := client.ReadReplyResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟目标服务器主动连入
+	peer, err := net.Dial("tcp", net.JoinHostPort(bndAddr, bndPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// 第二次回复：连入的目标服务器的地址
+	_, peerAddr, peerPort, err := client.ReadReplyResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := net.JoinHostPort(peerAddr, peerPort); got != peer.LocalAddr().String() {
+		t.Fatalf("second reply addr = %v, want %v", got, peer.LocalAddr())
+	}
+
+	go func() {
+		buf := make([]byte, 64)
+		n, err := peer.Read(buf)
+		if err != nil {
+			return
+		}
+		peer.Write(buf[:n])
+	}()
+
+	assertEcho(t, conn, "hello bind")
+}
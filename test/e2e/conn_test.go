@@ -1,13 +1,18 @@
 package e2e
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"testing"
+	"time"
 
 	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
 	"zz.io/cargo/so5/server"
+	"zz.io/cargo/so5/util"
 )
 
 func init() {
@@ -15,37 +20,295 @@ func init() {
 }
 
 func TestServer(t *testing.T) {
-	if err := server.ListenAndServer("127.0.0.1:8080"); err != nil {
+	// 目标回复一次后主动关闭，客户端收到 EOF 后也关闭，使转发结束，Shutdown 可以正常等到所有连接结束
+	targetLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetLis.Close()
+	go func() {
+		conn, err := targetLis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		conn.Write(buf[:n])
+	}()
+	target := targetLis.Addr().String()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
 		t.Fatal(err)
 	}
+	srv := server.New(server.Config{})
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(lis) }()
+
+	conn := dial(t, lis.Addr().String())
+	defer conn.Close()
+	connectThrough(t, conn, target)
+	assertEcho(t, conn, "hello server")
+
+	// 目标关闭后 FIN 应当传递给客户端
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Read() after target closed = %d, %v, want EOF", n, err)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if err := <-serveErr; !errors.Is(err, server.ErrServerClosed) {
+		t.Fatalf("Serve() error = %v, want %v", err, server.ErrServerClosed)
+	}
 }
 
 func TestClient(t *testing.T) {
-	if err := client.ListenAndServer("127.0.0.1:8081", "127.0.0.1:8080", "127.0.0.1:8083"); err != nil {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+
+	clientAddr := startClient(t, proxyAddr, target, nil)
+
+	conn := dialRetry(t, clientAddr)
+	defer conn.Close()
+
+	assertEcho(t, conn, "hello client")
+}
+
+// TestServerShutdownForce Shutdown 超时后强制关闭仍在转发的连接
+func TestServerShutdownForce(t *testing.T) {
+	target := startEchoServer(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
 		t.Fatal(err)
 	}
+	srv := server.New(server.Config{})
+	go srv.Serve(lis)
+
+	conn := dial(t, lis.Addr().String())
+	defer conn.Close()
+	connectThrough(t, conn, target)
+	assertEcho(t, conn, "still relaying")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect relay closed by shutdown, got %v", err)
+	}
 }
 
-func TestTargetServer(t *testing.T) {
-	lis, err := net.Listen("tcp", "127.0.0.1:8083")
+// TestServerHandshake 走一遍完整的 RFC 1928 流程：方法协商 -> 请求 -> 转发
+func TestServerHandshake(t *testing.T) {
+	target := startEchoServer(t)
+
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{server.NoAuth{}}})
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	method, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeUnamePwd, consts.AuthTypeNoRequired})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer lis.Close()
+	if method != consts.AuthTypeNoRequired {
+		t.Fatalf("method = %#x, want %#x", method, consts.AuthTypeNoRequired)
+	}
 
-	for {
-		conn, err := lis.Accept()
-		if err != nil {
-			t.Error(err)
-			continue
-		}
+	atyp, adr, port, err := util.ParseAddr(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteRequest(conn, atyp, adr, port); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := client.ReadReplyResponse(conn); err != nil {
+		t.Fatal(err)
+	}
 
-		go func() {
-			_, err := io.Copy(conn, conn)
+	assertEcho(t, conn, "hello so5")
+}
+
+// TestServerNoAcceptableMethod 客户端不支持服务端的任何认证方式时，服务端回复 0xFF 并断开
+func TestServerNoAcceptableMethod(t *testing.T) {
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{rootAuth}})
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	method, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != consts.AuthTypeNoAcceptable {
+		t.Fatalf("method = %#x, want %#x", method, consts.AuthTypeNoAcceptable)
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect server close conn, got %v", err)
+	}
+}
+
+func startEchoServer(t *testing.T) string {
+	return startEchoServerOn(t, "127.0.0.1:0")
+}
+
+func startEchoServerOn(t *testing.T, addr string) string {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
 			if err != nil {
-				t.Error(err)
 				return
 			}
-		}()
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return lis.Addr().String()
+}
+
+// startServer 在 addr 上启动服务端，测试结束时关闭，返回实际监听的地址
+func startServer(t *testing.T, addr string, cfg server.Config) string {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := server.New(cfg)
+	go srv.Serve(lis)
+	t.Cleanup(func() {
+		// 测试中的转发大多不会自行结束，稍等后强制关闭即可
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+
+	return lis.Addr().String()
+}
+
+// startClient 在随机端口上启动经由 proxyAddr 转发到 target 的客户端，测试结束时关闭，返回监听的地址
+func startClient(t *testing.T, proxyAddr, target string, opts *client.Options) string {
+	addr := freeAddr(t)
+	forwards := []client.Forward{{ListenAddr: addr, ProxyAddr: proxyAddr, TargetAddr: target, Options: opts}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.ListenAndServeForwards(ctx, forwards) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return addr
+}
+
+// connectThrough 在已连接服务端的 conn 上完成无需认证的握手并 CONNECT 到 target
+func connectThrough(t *testing.T, conn net.Conn, target string) {
+	t.Helper()
+	if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+		t.Fatal(err)
+	}
+	atyp, adr, port, err := util.ParseAddr(target)
+	if err != nil {
+		t.Fatal(err)
 	}
+	if err := client.WriteRequest(conn, atyp, adr, port); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := client.ReadReplyResponse(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// dialRetry 等待后台启动的服务端开始监听
+func dialRetry(t *testing.T, addr string) net.Conn {
+	var err error
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+func assertEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func TestServerIPv6(t *testing.T) {
+	lis, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available:", err)
+	}
+	lis.Close()
+
+	target := startEchoServerOn(t, "[::1]:0")
+
+	proxyAddr := startServer(t, "[::1]:0", server.Config{})
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+		t.Fatal(err)
+	}
+
+	atyp, adr, port, err := util.ParseAddr(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atyp != consts.AtypIpv6 || len(adr) != net.IPv6len {
+		t.Fatalf("ParseAddr(%v) = atyp %#x, %d bytes", target, atyp, len(adr))
+	}
+	if err := client.WriteRequest(conn, atyp, adr, port); err != nil {
+		t.Fatal(err)
+	}
+
+	bndAtyp, _, _, err := client.ReadReplyResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bndAtyp != consts.AtypIpv6 {
+		t.Fatalf("reply atyp = %#x, want %#x", bndAtyp, consts.AtypIpv6)
+	}
+
+	assertEcho(t, conn, "hello ipv6")
 }
@@ -0,0 +1,65 @@
+package e2e
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/htpasswd"
+	"zz.io/cargo/so5/server"
+)
+
+func TestServerFileCredentialsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	setUser := func(alg, user, pwd string) {
+		t.Helper()
+		hash, err := htpasswd.Hash(alg, pwd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := htpasswd.Edit(path, func(f *htpasswd.File) error { return f.Set(user, hash) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setUser(htpasswd.Bcrypt, "alice", "old")
+	setUser(htpasswd.Argon2id, "bob", "argon")
+
+	creds, err := server.NewFileCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer creds.Close()
+
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{server.UserPassAuth{Store: creds}}})
+
+	auth := func(user, pwd string) error {
+		conn := dial(t, proxyAddr)
+		defer conn.Close()
+		if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeUnamePwd}); err != nil {
+			return err
+		}
+		return client.AuthUseUnamePwd(conn, user, pwd)
+	}
+
+	if err := auth("alice", "old"); err != nil {
+		t.Fatalf("bcrypt user: %v", err)
+	}
+	if err := auth("bob", "argon"); err != nil {
+		t.Fatalf("argon2id user: %v", err)
+	}
+
+	setUser(htpasswd.Bcrypt, "alice", "new")
+	deadline := time.Now().Add(3 * server.CredentialsReloadInterval)
+	for auth("alice", "new") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("credentials file was not reloaded")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	if err := auth("alice", "old"); err == nil {
+		t.Fatal("old password still accepted after reload")
+	}
+}
@@ -0,0 +1,118 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/server"
+)
+
+// 与 golang.org/x/net/proxy 中的接口相同
+var (
+	_ interface {
+		Dial(network, addr string) (net.Conn, error)
+	} = (*client.Dialer)(nil)
+	_ interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	} = (*client.Dialer)(nil)
+)
+
+func TestClientDialer(t *testing.T) {
+	target := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{rootAuth}})
+	d := &client.Dialer{ProxyAddr: proxyAddr, Options: &client.Options{Auth: &client.Auth{Username: username, Password: password}}}
+
+	tests := []struct {
+		name string
+		addr string
+	}{
+		{name: "ip", addr: target},
+		{name: "domain", addr: net.JoinHostPort("localhost", port)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := d.Dial("tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// RemoteAddr 为目标而不是 socks5 server
+			if got := conn.RemoteAddr().String(); got != tt.addr {
+				t.Fatalf("RemoteAddr = %v, want %v", got, tt.addr)
+			}
+			assertEcho(t, conn, "hello dialer")
+		})
+	}
+}
+
+func TestClientDialerHTTPTransport(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello transport")
+	}))
+	defer target.Close()
+
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+	d := &client.Dialer{ProxyAddr: proxyAddr}
+	tr := &http.Transport{DialContext: d.DialContext}
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: tr}).Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello transport" {
+		t.Fatalf("body = %q, want %q", body, "hello transport")
+	}
+}
+
+// TestClientDialerContext 握手期间 ctx 结束时立即返回
+func TestClientDialerContext(t *testing.T) {
+	// 只接受连接、从不回复的服务端
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := &client.Dialer{ProxyAddr: lis.Addr().String(), Options: &client.Options{HandshakeTimeout: 10 * time.Second}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = d.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("DialContext error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("DialContext returned after %v, want about 100ms", elapsed)
+	}
+
+	if _, err := d.Dial("udp", "127.0.0.1:53"); err == nil {
+		t.Fatal("Dial(udp) = nil error, want unknown network")
+	}
+}
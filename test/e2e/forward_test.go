@@ -0,0 +1,86 @@
+package e2e
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/server"
+)
+
+// freeAddr 返回一个当前空闲的本机地址
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func TestClientForwards(t *testing.T) {
+	target1 := startEchoServer(t)
+	target2 := startEchoServer(t)
+	// 两条转发使用不同的上游，其中一个需要认证
+	proxy1 := startServer(t, "127.0.0.1:0", server.Config{})
+	proxy2 := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{rootAuth}})
+
+	forwards := []client.Forward{
+		{ListenAddr: freeAddr(t), ProxyAddr: proxy1, TargetAddr: target1},
+		{ListenAddr: freeAddr(t), ProxyAddr: proxy2, TargetAddr: target2,
+			Options: &client.Options{Auth: &client.Auth{Username: username, Password: password}}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.ListenAndServeForwards(ctx, forwards) }()
+
+	conns := make([]net.Conn, len(forwards))
+	for i, f := range forwards {
+		conns[i] = dialRetry(t, f.ListenAddr)
+		defer conns[i].Close()
+		assertEcho(t, conns[i], "hello "+f.TargetAddr)
+	}
+
+	// 取消后关闭所有监听和正在转发的连接
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ListenAndServeForwards = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServeForwards not returned after cancel")
+	}
+	for _, conn := range conns {
+		assertClosedWithin(t, conn, time.Second)
+	}
+	for _, f := range forwards {
+		if conn, err := net.Dial("tcp", f.ListenAddr); err == nil {
+			conn.Close()
+			t.Fatalf("%v still listening after cancel", f.ListenAddr)
+		}
+	}
+}
+
+func TestClientForwardsListenError(t *testing.T) {
+	busy := startEchoServer(t)
+	free := freeAddr(t)
+
+	forwards := []client.Forward{
+		{ListenAddr: free, ProxyAddr: "127.0.0.1:1", TargetAddr: "127.0.0.1:1"},
+		{ListenAddr: busy, ProxyAddr: "127.0.0.1:1", TargetAddr: "127.0.0.1:1"},
+	}
+	if err := client.ListenAndServeForwards(context.Background(), forwards); err == nil {
+		t.Fatal("ListenAndServeForwards with a busy address = nil, want error")
+	}
+
+	// 已经监听的地址也要释放
+	lis, err := net.Listen("tcp", free)
+	if err != nil {
+		t.Fatalf("%v not released: %v", free, err)
+	}
+	lis.Close()
+}
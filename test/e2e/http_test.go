@@ -0,0 +1,161 @@
+package e2e
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"zz.io/cargo/so5/server"
+)
+
+// httpConnect 在 conn 上发送 CONNECT 请求并读取响应，extra 为紧跟在请求之后发送的数据
+func httpConnect(t *testing.T, conn net.Conn, target, header, extra string) *http.Response {
+	t.Helper()
+	_, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n%s", target, target, header, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 200 之后是隧道中的数据，不能多读，因此逐字节读取响应
+	resp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) { return o.r.Read(p[:1]) }
+
+func TestServerHTTPConnect(t *testing.T) {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	// 客户端在收到 200 之前就发送的数据也要转发给目标
+	resp := httpConnect(t, conn, target, "", "early ")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v, want 200", resp.Status)
+	}
+
+	buf := make([]byte, len("early "))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "early " {
+		t.Fatalf("echo = %q, want %q", buf, "early ")
+	}
+	assertEcho(t, conn, "hello http connect")
+}
+
+func TestServerHTTPForward(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer target.Close()
+
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{rootAuth}})
+	proxyURL := &url.URL{Scheme: "http", Host: proxyAddr, User: url.UserPassword(username, password)}
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	defer tr.CloseIdleConnections()
+	c := &http.Client{Transport: tr}
+
+	// 同一个连接上发送两个请求
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := c.Get(target.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "GET " + path; string(body) != want {
+			t.Fatalf("body = %q, want %q", body, want)
+		}
+
+		h := <-headers
+		if v := h.Get("Proxy-Authorization"); v != "" {
+			t.Fatalf("Proxy-Authorization forwarded to target: %q", v)
+		}
+	}
+}
+
+func TestServerHTTPAuth(t *testing.T) {
+	target := startEchoServer(t)
+
+	got := make(chan server.AuthInfo, 1)
+	cfg := server.Config{
+		Auths: []server.Authenticator{rootAuth},
+		AllowRequest: func(ctx context.Context, req *server.Request) bool {
+			got <- req.Auth
+			return true
+		},
+	}
+	proxyAddr := startServer(t, "127.0.0.1:0", cfg)
+
+	basic := func(user, pass string) string {
+		r := &http.Request{Header: http.Header{}}
+		r.SetBasicAuth(user, pass)
+		return "Proxy-Authorization: " + r.Header.Get("Authorization") + "\r\n"
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{name: "no credentials", status: http.StatusProxyAuthRequired},
+		{name: "wrong password", header: basic(username, "wrong"), status: http.StatusProxyAuthRequired},
+		{name: "ok", header: basic(username, password), status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+
+			resp := httpConnect(t, conn, target, tt.header, "")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %v, want %d", resp.Status, tt.status)
+			}
+			if tt.status == http.StatusProxyAuthRequired {
+				if resp.Header.Get("Proxy-Authenticate") == "" {
+					t.Fatal("407 without Proxy-Authenticate")
+				}
+				return
+			}
+
+			if info := <-got; info.Identity != username {
+				t.Fatalf("Request.Auth.Identity = %q, want %q", info.Identity, username)
+			}
+			assertEcho(t, conn, "hello")
+		})
+	}
+}
+
+func TestServerHTTPNotAllowed(t *testing.T) {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{
+		AllowRequest: func(ctx context.Context, req *server.Request) bool { return false },
+	})
+
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	if resp := httpConnect(t, conn, target, "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %v, want 403", resp.Status)
+	}
+}
@@ -0,0 +1,188 @@
+package e2e
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/server"
+	"zz.io/cargo/so5/util"
+)
+
+// startLocalServer 启动经由 proxyAddr 转发的本地服务端，返回监听的地址
+func startLocalServer(t *testing.T, proxyAddr string, opts *client.Options) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := client.NewLocalServer(proxyAddr, opts)
+	go srv.Serve(lis)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+
+	return lis.Addr().String()
+}
+
+func TestClientLocalServer(t *testing.T) {
+	target := startEchoServer(t)
+
+	// 上游只接受用户名/密码认证，并记录实际请求的目标
+	dsts := make(chan string, 2)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{
+		Auths: []server.Authenticator{rootAuth},
+		AllowRequest: func(ctx context.Context, req *server.Request) bool {
+			dsts <- net.JoinHostPort(req.DstAddr, req.DstPort)
+			return true
+		},
+	})
+	localAddr := startLocalServer(t, proxyAddr, &client.Options{Auth: &client.Auth{Username: username, Password: password}})
+
+	t.Run("socks5", func(t *testing.T) {
+		conn := dial(t, localAddr)
+		defer conn.Close()
+
+		connectThrough(t, conn, target)
+		if dst := <-dsts; dst != target {
+			t.Fatalf("upstream dst = %v, want %v", dst, target)
+		}
+		assertEcho(t, conn, "hello local socks5")
+	})
+
+	t.Run("http", func(t *testing.T) {
+		conn := dial(t, localAddr)
+		defer conn.Close()
+
+		if resp := httpConnect(t, conn, target, "", ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %v, want 200", resp.Status)
+		}
+		if dst := <-dsts; dst != target {
+			t.Fatalf("upstream dst = %v, want %v", dst, target)
+		}
+		assertEcho(t, conn, "hello local http")
+	})
+}
+
+func TestClientLocalServerRejected(t *testing.T) {
+	target := startEchoServer(t)
+
+	tests := []struct {
+		name      string
+		proxyAddr string
+		cmd       byte
+		rep       byte
+	}{
+		// 上游拒绝认证时 CONNECT 失败
+		{name: "upstream auth failed", proxyAddr: startServer(t, "127.0.0.1:0", server.Config{
+			Auths: []server.Authenticator{rootAuth},
+		}), cmd: consts.CmdConnect, rep: consts.RepFailed},
+		// BIND 和 UDP ASSOCIATE 无法经由上游转发
+		{name: "udp associate", proxyAddr: startServer(t, "127.0.0.1:0", server.Config{}), cmd: consts.CmdUdp, rep: consts.RepNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localAddr := startLocalServer(t, tt.proxyAddr, nil)
+			conn := dial(t, localAddr)
+			defer conn.Close()
+
+			if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+				t.Fatal(err)
+			}
+			atyp, adr, port, err := util.ParseAddr(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.WriteCmdRequest(conn, tt.cmd, atyp, adr, port); err != nil {
+				t.Fatal(err)
+			}
+
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				t.Fatal(err)
+			}
+			if b[1] != tt.rep {
+				t.Fatalf("REP = %#x, want %#x", b[1], tt.rep)
+			}
+		})
+	}
+}
+
+// TestClientLocalServerUpstreamReply 本地服务端把上游回复中的 REP 和 BND 原样回复给客户端
+func TestClientLocalServerUpstreamReply(t *testing.T) {
+	target := startEchoServer(t)
+
+	// 记录上游连接目标时使用的本地地址，也就是上游回复的 BND
+	bound := make(chan string, 1)
+	recordDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			bound <- conn.LocalAddr().String()
+		}
+		return conn, err
+	}
+
+	tests := []struct {
+		name   string
+		cfg    server.Config
+		target string
+		rep    byte
+		status int
+	}{
+		{name: "success", cfg: server.Config{Dial: recordDial}, target: target, rep: consts.RepSuccess, status: http.StatusOK},
+		{name: "not allowed", cfg: server.Config{
+			AllowRequest: func(ctx context.Context, req *server.Request) bool { return false },
+		}, target: target, rep: consts.RepNotAllowed, status: http.StatusForbidden},
+		{name: "connection refused", target: freeAddr(t), rep: consts.RepConnectionRefused, status: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localAddr := startLocalServer(t, startServer(t, "127.0.0.1:0", tt.cfg), nil)
+
+			conn := dial(t, localAddr)
+			defer conn.Close()
+			if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+				t.Fatal(err)
+			}
+			atyp, adr, port, err := util.ParseAddr(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.WriteRequest(conn, atyp, adr, port); err != nil {
+				t.Fatal(err)
+			}
+			var reply protocol.Reply
+			if _, err := reply.ReadFrom(conn); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Rep != tt.rep {
+				t.Fatalf("socks5 REP = %#x, want %#x", reply.Rep, tt.rep)
+			}
+			if tt.rep == consts.RepSuccess {
+				if want := <-bound; reply.Addr.String() != want {
+					t.Fatalf("socks5 BND = %v, want upstream BND %v", reply.Addr, want)
+				}
+			}
+
+			httpConn := dial(t, localAddr)
+			defer httpConn.Close()
+			if resp := httpConnect(t, httpConn, tt.target, "", ""); resp.StatusCode != tt.status {
+				t.Fatalf("http status = %v, want %v", resp.Status, tt.status)
+			}
+			if tt.rep == consts.RepSuccess {
+				<-bound
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package e2e
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/server"
+)
+
+// TestServerHalfClose 客户端发送完数据后只关闭写方向，目标服务器读到 EOF 后才回复，
+// 要求 FIN 能经过服务端传递给目标，回复也能完整地传回客户端
+func TestServerHalfClose(t *testing.T) {
+	target := startReplyOnEOFServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+	connectThrough(t, conn, target)
+
+	assertHalfClose(t, conn, "hello half-close")
+}
+
+func TestClientHalfClose(t *testing.T) {
+	target := startReplyOnEOFServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+
+	clientAddr := startClient(t, proxyAddr, target, nil)
+
+	conn := dialRetry(t, clientAddr)
+	defer conn.Close()
+
+	assertHalfClose(t, conn, "hello client half-close")
+}
+
+// startReplyOnEOFServer 启动一个目标服务器：读完客户端的全部数据（直到 EOF）后原样回复，然后关闭连接
+func startReplyOnEOFServer(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(b)
+			}()
+		}
+	}()
+
+	return lis.Addr().String()
+}
+
+func assertHalfClose(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte(msg)) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
@@ -0,0 +1,144 @@
+package e2e
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/server"
+)
+
+func TestClientRemoteForward(t *testing.T) {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{
+		Auths: []server.Authenticator{rootAuth},
+		AllowRemoteForward: func(ctx context.Context, req *server.Request) bool {
+			return req.Auth.Identity == username
+		},
+	})
+
+	remoteAddr := freeAddr(t)
+	forwards := []client.Forward{{
+		ListenAddr: remoteAddr, ProxyAddr: proxyAddr, TargetAddr: target, Remote: true,
+		Options: &client.Options{Auth: &client.Auth{Username: username, Password: password}},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.ListenAndServeForwards(ctx, forwards) }()
+
+	// 服务端上监听的端口连入的每个连接都转发到客户端这一侧的 target
+	for _, msg := range []string{"hello remote 1", "hello remote 2"} {
+		conn := dialRetry(t, remoteAddr)
+		defer conn.Close()
+		assertEcho(t, conn, msg)
+	}
+
+	// 客户端退出后服务端停止监听
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("ListenAndServeForwards = %v, want nil", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", remoteAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("%v still listening after client exit", remoteAddr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientRemoteForwardNotAllowed(t *testing.T) {
+	target := startEchoServer(t)
+
+	tests := []struct {
+		name  string
+		allow func(ctx context.Context, req *server.Request) bool
+	}{
+		// 未配置策略时不允许远程端口转发
+		{name: "no policy"},
+		{name: "policy rejects", allow: func(ctx context.Context, req *server.Request) bool { return false }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyAddr := startServer(t, "127.0.0.1:0", server.Config{AllowRemoteForward: tt.allow})
+			forwards := []client.Forward{{ListenAddr: freeAddr(t), ProxyAddr: proxyAddr, TargetAddr: target, Remote: true}}
+			if err := client.ListenAndServeForwards(context.Background(), forwards); err == nil {
+				t.Fatal("ListenAndServeForwards = nil, want error")
+			}
+		})
+	}
+}
+
+// TestServerRemoteAcceptOwner 只有发起监听的客户可以认领连入的连接
+func TestServerRemoteAcceptOwner(t *testing.T) {
+	creds := server.StaticCredentials{"alice": "a", "bob": "b"}
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{
+		Auths:              []server.Authenticator{server.UserPassAuth{Store: creds}},
+		AllowRemoteForward: func(ctx context.Context, req *server.Request) bool { return true },
+	})
+
+	// remoteRequest 以 user 的身份发送 cmd 请求并读取回复
+	remoteRequest := func(user string, cmd byte, addr protocol.Addr) (net.Conn, protocol.Reply) {
+		conn := dial(t, proxyAddr)
+		t.Cleanup(func() { conn.Close() })
+		if err := client.Authenticate(conn, &client.Auth{Username: user, Password: creds[user]}); err != nil {
+			t.Fatal(err)
+		}
+		req := protocol.Request{Cmd: cmd, Addr: addr}
+		if _, err := req.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+		var reply protocol.Reply
+		if _, err := reply.ReadFrom(conn); err != nil {
+			t.Fatal(err)
+		}
+		return conn, reply
+	}
+
+	control, reply := remoteRequest("alice", consts.CmdRemoteListen, protocol.Addr{Type: consts.AtypIPv4, Host: "127.0.0.1"})
+	if reply.Rep != consts.RepSuccess {
+		t.Fatalf("listen REP = %#x, want success", reply.Rep)
+	}
+
+	peer := dial(t, reply.Addr.String())
+	defer peer.Close()
+
+	// 连入通知中是 peer 的地址
+	var notify protocol.Reply
+	if _, err := notify.ReadFrom(control); err != nil {
+		t.Fatal(err)
+	}
+	if notify.Addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("notified peer = %v, want %v", notify.Addr, peer.LocalAddr())
+	}
+
+	if _, reply := remoteRequest("bob", consts.CmdRemoteAccept, notify.Addr); reply.Rep != consts.RepNotAllowed {
+		t.Fatalf("bob accept REP = %#x, want %#x", reply.Rep, consts.RepNotAllowed)
+	}
+
+	conn, reply := remoteRequest("alice", consts.CmdRemoteAccept, notify.Addr)
+	if reply.Rep != consts.RepSuccess {
+		t.Fatalf("alice accept REP = %#x, want success", reply.Rep)
+	}
+
+	go func() {
+		buf := make([]byte, 64)
+		n, err := peer.Read(buf)
+		if err != nil {
+			return
+		}
+		peer.Write(buf[:n])
+	}()
+	assertEcho(t, conn, "hello remote accept")
+}
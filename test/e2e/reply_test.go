@@ -0,0 +1,148 @@
+package e2e
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/server"
+	"zz.io/cargo/so5/util"
+)
+
+func TestServerReplyCode(t *testing.T) {
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+
+	// 拿到一个当前没有被监听的端口
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedAddr := lis.Addr().String()
+	lis.Close()
+
+	tests := []struct {
+		name    string
+		request func(conn net.Conn) error
+		rep     byte
+	}{
+		{
+			name: "connection refused",
+			request: func(conn net.Conn) error {
+				atyp, adr, port, err := util.ParseAddr(refusedAddr)
+				if err != nil {
+					return err
+				}
+				return client.WriteRequest(conn, atyp, adr, port)
+			},
+			rep: consts.RepConnectionRefused,
+		},
+		{
+			name: "command not supported",
+			request: func(conn net.Conn) error {
+				return client.WriteCmdRequest(conn, 0x09, consts.AtypIPv4, []byte{127, 0, 0, 1}, 80)
+			},
+			rep: consts.RepCmdNotSupported,
+		},
+		{
+			name: "address type not supported",
+			request: func(conn net.Conn) error {
+				_, err := conn.Write([]byte{consts.Version, consts.CmdConnect, consts.RSV, 0x09})
+				return err
+			},
+			rep: consts.RepAddrTypeUnsupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+
+			if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.request(conn); err != nil {
+				t.Fatal(err)
+			}
+
+			// 只关心 VER 和 REP
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				t.Fatal(err)
+			}
+			if b[1] != tt.rep {
+				t.Fatalf("REP = %#x, want %#x", b[1], tt.rep)
+			}
+		})
+	}
+}
+
+// TestServerConnectBndAddr CONNECT 的回复中 BND.ADDR/BND.PORT 为服务端连接目标时使用的本地地址，
+// 服务端监听的地址为主机名时也能正常工作
+func TestServerConnectBndAddr(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	peerAddr := make(chan string, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		peerAddr <- conn.RemoteAddr().String()
+		io.Copy(io.Discard, conn)
+	}()
+
+	proxyAddr := startServer(t, "localhost:0", server.Config{})
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+		t.Fatal(err)
+	}
+	atyp, adr, port, err := util.ParseAddr(lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteRequest(conn, atyp, adr, port); err != nil {
+		t.Fatal(err)
+	}
+
+	bndAtyp, bndAddr, bndPort, err := client.ReadReplyResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bndAtyp != consts.AtypIPv4 {
+		t.Fatalf("reply atyp = %#x, want %#x", bndAtyp, consts.AtypIPv4)
+	}
+	if got, want := net.JoinHostPort(bndAddr, bndPort), <-peerAddr; got != want {
+		t.Fatalf("reply BND = %v, want %v", got, want)
+	}
+}
+
+// TestClientReplyError REP 不为成功时 ReadReplyResponse 返回带 REP 的 *client.ReplyError
+func TestClientReplyError(t *testing.T) {
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteCmdRequest(conn, 0x09, consts.AtypIPv4, []byte{127, 0, 0, 1}, 80); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err := client.ReadReplyResponse(conn)
+	var replyErr *client.ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Rep != consts.RepCmdNotSupported {
+		t.Fatalf("ReadReplyResponse error = %v, want *client.ReplyError with REP %#x", err, consts.RepCmdNotSupported)
+	}
+}
@@ -0,0 +1,183 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/server"
+)
+
+// socks4Request 发送 SOCKS4 请求，domain 不为空时使用 SOCKS4A
+func socks4Request(t *testing.T, conn net.Conn, cmd byte, target, userID, domain string) {
+	t.Helper()
+	ap, err := netip.ParseAddrPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := protocol.Socks4Request{Cmd: cmd, Port: ap.Port(), IP: ap.Addr().As4(), UserID: userID}
+	if domain != "" {
+		req.IP = [4]byte{0, 0, 0, 1}
+		req.Domain = domain
+	}
+	if _, err := req.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSocks4Reply(t *testing.T, conn net.Conn) protocol.Socks4Reply {
+	t.Helper()
+	var reply protocol.Socks4Reply
+	if _, err := reply.ReadFrom(conn); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestServerSocks4Connect(t *testing.T) {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+
+	tests := []struct {
+		name   string
+		domain string
+	}{
+		{name: "socks4"},
+		{name: "socks4a", domain: "localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+
+			socks4Request(t, conn, consts.CmdConnect, target, "nobody", tt.domain)
+			if reply := readSocks4Reply(t, conn); reply.Rep != consts.Socks4RepGranted {
+				t.Fatalf("CD = %#x, want %#x", reply.Rep, consts.Socks4RepGranted)
+			}
+
+			assertEcho(t, conn, "hello "+tt.name)
+		})
+	}
+}
+
+func TestServerSocks4Bind(t *testing.T) {
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	socks4Request(t, conn, consts.CmdBind, "127.0.0.1:0", "", "")
+
+	// 第一次回复：服务端监听的地址
+	first := readSocks4Reply(t, conn)
+	if first.Rep != consts.Socks4RepGranted {
+		t.Fatalf("CD = %#x, want %#x", first.Rep, consts.Socks4RepGranted)
+	}
+	bnd := net.JoinHostPort(netip.AddrFrom4(first.IP).String(), strconv.Itoa(int(first.Port)))
+
+	peer, err := net.Dial("tcp", bnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// 第二次回复：连入的目标服务器的地址
+	second := readSocks4Reply(t, conn)
+	got := net.JoinHostPort(netip.AddrFrom4(second.IP).String(), strconv.Itoa(int(second.Port)))
+	if got != peer.LocalAddr().String() {
+		t.Fatalf("second reply addr = %v, want %v", got, peer.LocalAddr())
+	}
+
+	go func() {
+		buf := make([]byte, 64)
+		n, err := peer.Read(buf)
+		if err != nil {
+			return
+		}
+		peer.Write(buf[:n])
+	}()
+
+	assertEcho(t, conn, "hello socks4 bind")
+}
+
+// userIDAuth 只接受 USERID 为 alice 的 SOCKS4 请求
+type userIDAuth struct{ server.NoAuth }
+
+func (userIDAuth) AuthenticateUserID(userID string) (string, error) {
+	if userID != "alice" {
+		return "", errors.New("unknown userid")
+	}
+	return userID, nil
+}
+
+func TestServerSocks4UserID(t *testing.T) {
+	target := startEchoServer(t)
+
+	got := make(chan server.AuthInfo, 1)
+	allow := func(ctx context.Context, req *server.Request) bool {
+		got <- req.Auth
+		return true
+	}
+
+	tests := []struct {
+		name     string
+		auths    []server.Authenticator
+		userID   string
+		rep      byte
+		identity string
+	}{
+		{name: "custom accepted", auths: []server.Authenticator{userIDAuth{}}, userID: "alice", rep: consts.Socks4RepGranted, identity: "alice"},
+		{name: "custom rejected", auths: []server.Authenticator{userIDAuth{}}, userID: "bob", rep: consts.Socks4RepRejected},
+		// USERID 中没有密码，只配置了用户名/密码认证时拒绝 SOCKS4
+		{name: "userpass only", auths: []server.Authenticator{rootAuth}, userID: username, rep: consts.Socks4RepRejected},
+		// 使用第一个实现了 UserIDAuthenticator 的认证方式
+		{name: "userpass then none", auths: []server.Authenticator{rootAuth, server.NoAuth{}}, userID: "bob", rep: consts.Socks4RepGranted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: tt.auths, AllowRequest: allow})
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+
+			socks4Request(t, conn, consts.CmdConnect, target, tt.userID, "")
+			if reply := readSocks4Reply(t, conn); reply.Rep != tt.rep {
+				t.Fatalf("CD = %#x, want %#x", reply.Rep, tt.rep)
+			}
+			if tt.rep != consts.Socks4RepGranted {
+				return
+			}
+
+			if info := <-got; info.Identity != tt.identity {
+				t.Fatalf("Request.Auth.Identity = %q, want %q", info.Identity, tt.identity)
+			}
+			assertEcho(t, conn, "hello")
+		})
+	}
+}
+
+// TestServerSocks4AndSocks5 同一个端口同时接受 SOCKS4 和 SOCKS5 客户端
+func TestServerSocks4AndSocks5(t *testing.T) {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+
+	conn5 := dial(t, proxyAddr)
+	defer conn5.Close()
+	connectThrough(t, conn5, target)
+
+	conn4 := dial(t, proxyAddr)
+	defer conn4.Close()
+	socks4Request(t, conn4, consts.CmdConnect, target, "", "")
+	if reply := readSocks4Reply(t, conn4); reply.Rep != consts.Socks4RepGranted {
+		t.Fatalf("CD = %#x, want %#x", reply.Rep, consts.Socks4RepGranted)
+	}
+
+	assertEcho(t, conn5, "hello socks5")
+	assertEcho(t, conn4, "hello socks4")
+}
@@ -0,0 +1,77 @@
+package e2e
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/server"
+)
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{HandshakeTimeout: 100 * time.Millisecond})
+
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	// 只发送 VER，之后不再发送数据
+	if _, err := conn.Write([]byte{0x05}); err != nil {
+		t.Fatal(err)
+	}
+	assertClosedWithin(t, conn, 2*time.Second)
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{IdleTimeout: 300 * time.Millisecond})
+
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+	connectThrough(t, conn, target)
+
+	// 在超时时间内持续有数据，连接不应被关闭
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		assertEcho(t, conn, "ping")
+	}
+
+	assertClosedWithin(t, conn, 2*time.Second)
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	// 只接受连接、从不回复的 socks5 server
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	app, conn := net.Pipe()
+	defer app.Close()
+
+	err = client.Dial(conn, lis.Addr().String(), "127.0.0.1:80", &client.Options{HandshakeTimeout: 100 * time.Millisecond})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Dial() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+// assertClosedWithin 断言 conn 在 d 内被对端关闭
+func assertClosedWithin(t *testing.T, conn net.Conn, d time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(d))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("expect conn closed by peer, got %v", err)
+	}
+}
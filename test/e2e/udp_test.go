@@ -0,0 +1,270 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"zz.io/cargo/so5/client"
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/server"
+)
+
+func TestServerUdpAssociate(t *testing.T) {
+	target := startUdpEchoServer(t)
+
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+	conn := dial(t, proxyAddr)
+	defer conn.Close()
+
+	if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+		t.Fatal(err)
+	}
+
+	// DST.ADDR/DST.PORT 为 0，表示客户端还不知道自己将会使用的地址
+	err := client.WriteCmdRequest(conn, consts.CmdUdp, consts.AtypIPv4, []byte{0, 0, 0, 0}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bndAddr, bndPort, err := client.ReadReplyResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(bndAddr, bndPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	msg := []byte("hello udp")
+	hdr := protocol.UDPHeader{Addr: protocol.AddrFromNet(target)}
+	packet, err := hdr.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := udpConn.Write(append(packet, msg...)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply protocol.UDPHeader
+	hn, err := reply.ReadFrom(bytes.NewReader(buf[:n]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf[hn:n]
+	if reply.Frag != 0 || reply.Addr.String() != target.String() {
+		t.Fatalf("reply header frag=%v addr=%v, want frag=0 addr=%v", reply.Frag, reply.Addr, target)
+	}
+	if !bytes.Equal(data, msg) {
+		t.Fatalf("reply data = %q, want %q", data, msg)
+	}
+}
+
+func TestClientListenPacket(t *testing.T) {
+	target := startUdpEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{Auths: []server.Authenticator{rootAuth}})
+	d := &client.Dialer{ProxyAddr: proxyAddr, Options: &client.Options{Auth: &client.Auth{Username: username, Password: password}}}
+
+	pc, err := d.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// 和普通的 net.PacketConn 一样收发，头部由 pc 处理
+	for _, msg := range []string{"hello packet 1", "hello packet 2"} {
+		if _, err := pc.WriteTo([]byte(msg), target); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 1024)
+		pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("ReadFrom data = %q, want %q", buf[:n], msg)
+		}
+		if from.String() != target.String() {
+			t.Fatalf("ReadFrom addr = %v, want %v", from, target)
+		}
+	}
+}
+
+// TestClientListenPacketClosed 服务端结束关联（关闭控制连接）后读取返回错误
+func TestClientListenPacketClosed(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(server.Config{})
+	go srv.Serve(lis)
+
+	d := &client.Dialer{ProxyAddr: lis.Addr().String()}
+	pc, err := d.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, _, err := pc.ReadFrom(make([]byte, 16)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("ReadFrom after association closed = %v, want closed error", err)
+	}
+}
+
+// TestServerUdpAssociateSource 只接受来自控制连接源 IP 的数据报，DST.ADDR/DST.PORT 只能进一步缩小范围
+func TestServerUdpAssociateSource(t *testing.T) {
+	target := startUdpEchoServer(t)
+	proxyAddr := startServer(t, "127.0.0.1:0", server.Config{})
+
+	listen := func(ip string) *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	tests := []struct {
+		name    string
+		dstAddr []byte
+		dstPort func(client *net.UDPConn) uint16
+		other   string // 从该 IP 上的另一个 socket 发送的数据报应被丢弃
+	}{
+		// DST.ADDR 指定了其他主机时不能让其代替控制连接的源 IP
+		{name: "dst addr other host", dstAddr: []byte{127, 0, 0, 2}, other: "127.0.0.2"},
+		{name: "dst addr zero", dstAddr: []byte{0, 0, 0, 0}, other: "127.0.0.2"},
+		// DST.PORT 不为 0 时同一 IP 上的其他端口也被丢弃
+		{name: "dst port", dstAddr: []byte{0, 0, 0, 0}, other: "127.0.0.1",
+			dstPort: func(client *net.UDPConn) uint16 { return uint16(client.LocalAddr().(*net.UDPAddr).Port) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			legit, other := listen("127.0.0.1"), listen(tt.other)
+			var port uint16
+			if tt.dstPort != nil {
+				port = tt.dstPort(legit)
+			}
+
+			conn := dial(t, proxyAddr)
+			defer conn.Close()
+			if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.WriteCmdRequest(conn, consts.CmdUdp, consts.AtypIPv4, tt.dstAddr, port); err != nil {
+				t.Fatal(err)
+			}
+			_, bndAddr, bndPort, err := client.ReadReplyResponse(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			relayAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(bndAddr, bndPort))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hdr := protocol.UDPHeader{Addr: protocol.AddrFromNet(target)}
+			packet, err := hdr.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			send := func(from *net.UDPConn, msg string) (string, error) {
+				if _, err := from.WriteToUDP(append(packet, msg...), relayAddr); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, 1024)
+				from.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+				n, err := from.Read(buf)
+				if err != nil {
+					return "", err
+				}
+				return string(buf[len(packet):n]), nil
+			}
+
+			if got, err := send(other, "from other"); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("datagram from %v relayed: %q, %v", other.LocalAddr(), got, err)
+			}
+			if got, err := send(legit, "from client"); err != nil || got != "from client" {
+				t.Fatalf("datagram from client: %q, %v, want echo", got, err)
+			}
+		})
+	}
+}
+
+// TestServerUdpAssociateUnix unix socket 上的连接没有源 IP，DST.ADDR 为 0 时回复失败而不是 panic
+func TestServerUdpAssociateUnix(t *testing.T) {
+	lis, err := net.Listen("unix", filepath.Join(t.TempDir(), "so5.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(server.Config{})
+	go srv.Serve(lis)
+	defer lis.Close()
+
+	conn, err := net.Dial("unix", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := client.NegotiationAuth(conn, []byte{consts.AuthTypeNoRequired}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteCmdRequest(conn, consts.CmdUdp, consts.AtypIPv4, []byte{0, 0, 0, 0}, 0); err != nil {
+		t.Fatal(err)
+	}
+	var reply protocol.Reply
+	if _, err := reply.ReadFrom(conn); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rep != consts.RepFailed {
+		t.Fatalf("REP = %#x, want %#x", reply.Rep, consts.RepFailed)
+	}
+}
+
+func startUdpEchoServer(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], src)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
@@ -1,6 +1,16 @@
+// Package pool 握手解析和数据转发使用的缓冲区池。
+//
+// 池中保存的是 *[]byte 而不是 []byte，避免 Put 时切片被装箱成 interface 产生额外的分配：
+//
+//	bp := pool.ByteSlice255.Get().(*[]byte)
+//	defer pool.ByteSlice255.Put(bp)
+//	b := *bp
 package pool
 
 import "sync"
 
-var ByteSlice2 = sync.Pool{New: func() any { return make([]byte, 2) }}
-var ByteSlice255 = sync.Pool{New: func() any { return make([]byte, 255) }}
+var ByteSlice2 = sync.Pool{New: func() any { b := make([]byte, 2); return &b }}
+var ByteSlice255 = sync.Pool{New: func() any { b := make([]byte, 255); return &b }}
+
+// ByteSlice32K 转发数据时每个方向使用的缓冲区，与 io.Copy 默认的大小相同
+var ByteSlice32K = sync.Pool{New: func() any { b := make([]byte, 32*1024); return &b }}
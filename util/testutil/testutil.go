@@ -0,0 +1,26 @@
+// Package testutil 各个包的测试共用的辅助函数
+package testutil
+
+import (
+	"runtime"
+	"testing"
+)
+
+// MaxParseAlloc 解析一个握手报文时允许在堆上分配的字节数。
+// 报文中的长度字段最大为 255，解析结果的大小与之相当，远小于该值；
+// 超过该值说明分配的大小受输入控制，例如根据伪造的长度字段分配了缓冲区
+const MaxParseAlloc = 16 * 1024
+
+// AssertBoundedAlloc 执行 fn，堆上分配的字节数超过 max 时测试失败
+func AssertBoundedAlloc(t testing.TB, max uint64, fn func()) {
+	t.Helper()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+
+	if n := after.TotalAlloc - before.TotalAlloc; n > max {
+		t.Fatalf("allocated %d bytes, want at most %d", n, max)
+	}
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+
+	"zz.io/cargo/so5/consts"
+	"zz.io/cargo/so5/protocol"
+	"zz.io/cargo/so5/util/testutil"
+)
+
+// FuzzParseAddrFromConn 按服务端的顺序先读 DST.ADDR 再读 DST.PORT
+func FuzzParseAddrFromConn(f *testing.F) {
+	f.Add(byte(consts.AtypIPv4), []byte{127, 0, 0, 1, 0x1f, 0x90})
+	f.Add(byte(consts.AtypDomain), append(append([]byte{11}, "example.com"...), 0x01, 0xbb))
+	f.Add(byte(consts.AtypIpv6), append(append([]byte{}, net.IPv6loopback...), 0x00, 0x50))
+	f.Add(byte(consts.AtypDomain), []byte{0, 0, 0})                    // 空域名
+	f.Add(byte(consts.AtypDomain), []byte{0xff, 'a'})                  // 域名长度超过剩余数据
+	f.Add(byte(consts.AtypIpv6), []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}) // 截断
+	f.Add(byte(0x09), []byte{127, 0, 0, 1, 0x1f, 0x90})                // 未知的 ATYP
+	f.Add(byte(consts.AtypIPv4), []byte{127, 0, 0, 1, 0x1f})           // 端口截断
+
+	f.Fuzz(func(t *testing.T, atyp byte, data []byte) {
+		r := bytes.NewReader(data)
+		var (
+			addr, port string
+			err        error
+		)
+		testutil.AssertBoundedAlloc(t, testutil.MaxParseAlloc, func() {
+			addr, err = ParseAddrFromConn(atyp, r)
+			if err == nil {
+				port, err = ParsePortFromConn(r)
+			}
+		})
+		if err != nil {
+			return
+		}
+
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			t.Fatalf("invalid port %q", port)
+		}
+		// 借助 UDP 头部编码地址，去掉 RSV、FRAG 和 ATYP 后就是 DST.ADDR 和 DST.PORT
+		hdr := protocol.UDPHeader{Addr: protocol.Addr{Type: atyp, Host: addr, Port: uint16(p)}}
+		b, err := hdr.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() of %+v error = %v", hdr, err)
+		}
+		if read := data[:len(data)-r.Len()]; !bytes.Equal(b[4:], read) {
+			t.Fatalf("re-encoded %v, read %v", b[4:], read)
+		}
+	})
+}